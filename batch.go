@@ -0,0 +1,110 @@
+package cache
+
+import "sync/atomic"
+
+// AddMany adds all the keyval pairs of pairs to the cache, as Add would. Keys
+// are grouped by shard, and the lock of each shard is taken once for all its
+// keys rather than once per key, which saves lock churn when adding large
+// batches. Removal callbacks for the entries evicted to make room are called
+// once each shard is unlocked.
+func (c *Cache) AddMany(pairs map[interface{}]interface{}) {
+	c.init()
+
+	keys := make([]interface{}, 0, len(pairs))
+	vals := make([]interface{}, 0, len(pairs))
+	for key, val := range pairs {
+		keys = append(keys, key)
+		vals = append(vals, val)
+	}
+	shards := c.allShards()
+	for i, group := range c.groupByShard(keys, false) {
+		if len(group) == 0 {
+			continue
+		}
+		s := shards[i]
+		s.Lock()
+		for _, j := range group {
+			s.set(keys[j], vals[j])
+		}
+		s.Unlock()
+	}
+}
+
+// GetMany is like Get for each of keys, and returns the values of the keys that
+// were found. As with AddMany, the lock of each shard is taken once for all its
+// keys. Caches with a read validator, see WithReadValidator and
+// AddWithValidator, or a fallback, see WithFallback, look up keys one at a
+// time, since validators and fallbacks are called without holding any lock.
+func (c *Cache) GetMany(keys []interface{}) map[interface{}]interface{} {
+	c.init()
+
+	res := make(map[interface{}]interface{}, len(keys))
+	if c.validate != nil || atomic.LoadInt32(&c.hasValidators) != 0 || c.fallback != nil {
+		for _, key := range keys {
+			if val, ok := c.Get(key); ok {
+				res[key] = val
+			}
+		}
+		return res
+	}
+
+	shards := c.allShards()
+	for i, group := range c.groupByShard(keys, c.lenientGet) {
+		if len(group) == 0 {
+			continue
+		}
+		s := shards[i]
+		s.Lock()
+		for _, j := range group {
+			key := keys[j]
+			if val, ok := s.lookup(key); ok {
+				atomic.AddUint64(&s.hits, 1)
+				res[key] = val
+			} else {
+				atomic.AddUint64(&s.misses, 1)
+			}
+		}
+		s.Unlock()
+	}
+	if c.copier != nil {
+		for key, val := range res {
+			res[key] = c.copy(val)
+		}
+	}
+	return res
+}
+
+// groupByShard returns the indexes of keys grouped by the index of their shard.
+// If lenient is true, keys that can't be hashed are left out rather than
+// causing a panic, see WithLenientGet.
+func (c *Cache) groupByShard(keys []interface{}, lenient bool) [][]int {
+	shardIdx := make([]int, len(keys))
+	sizes := make([]int, c.nshards)
+	for i, key := range keys {
+		shardIdx[i] = -1
+		if lenient {
+			if s, ok := c.tryShard(key); ok {
+				shardIdx[i] = s.i
+			}
+		} else {
+			shardIdx[i] = c.shardIndex(c.hash(key))
+		}
+		if shardIdx[i] >= 0 {
+			sizes[shardIdx[i]]++
+		}
+	}
+
+	// the groups share a single backing array
+	all := make([]int, 0, len(keys))
+	groups := make([][]int, c.nshards)
+	for i, n := range sizes {
+		groups[i] = all[len(all) : len(all) : len(all)+n]
+		all = all[:len(all)+n]
+	}
+	for i, j := range shardIdx {
+		if j >= 0 {
+			groups[j] = append(groups[j], i)
+		}
+	}
+	return groups
+}
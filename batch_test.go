@@ -0,0 +1,124 @@
+package cache_test
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/robteix/cache"
+)
+
+func TestCache_AddMany(t *testing.T) {
+	batch := cache.New(cache.WithShards(4), cache.WithCapacity(20))
+	single := cache.New(cache.WithShards(4), cache.WithCapacity(20))
+	pairs := make(map[interface{}]interface{})
+	for i := 0; i < 50; i++ {
+		pairs[i] = i * 10
+	}
+	batch.AddMany(pairs)
+	for key, val := range pairs {
+		single.Add(key, val)
+	}
+
+	for i := 0; i < 4; i++ {
+		if batch.ShardLen(i) != single.ShardLen(i) {
+			t.Errorf("shard %d holds %d entries, want %d", i, batch.ShardLen(i), single.ShardLen(i))
+		}
+	}
+	for _, key := range batch.Keys() {
+		if v, _ := batch.Peek(key); v != pairs[key] {
+			t.Errorf("got %v for %v, want %v", v, key, pairs[key])
+		}
+	}
+	if err := batch.CheckInvariants(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCache_GetMany(t *testing.T) {
+	for _, c := range []*cache.Cache{
+		cache.New(cache.WithShards(4)),
+		cache.New(cache.WithShards(4), cache.WithReadValidator(func(key, value interface{}) bool {
+			return value != 3
+		})),
+	} {
+		for i := 0; i < 10; i++ {
+			c.Add(i, i)
+		}
+
+		keys := []interface{}{1, 3, 5, 42, 5}
+		got := c.GetMany(keys)
+		want := make(map[interface{}]interface{})
+		for _, key := range keys {
+			if v, ok := c.Get(key); ok {
+				want[key] = v
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+
+	c := cache.New(cache.WithLenientGet())
+	c.Add(1, 1)
+	if got := c.GetMany([]interface{}{1, func() {}}); !reflect.DeepEqual(got, map[interface{}]interface{}{1: 1}) {
+		t.Errorf("got %v, want only 1", got)
+	}
+}
+
+// batches are looked up concurrently, which is where taking fewer locks matters
+func BenchmarkGetMany(b *testing.B) {
+	c := cache.New(cache.WithShards(16))
+	keys := make([]interface{}, 1000)
+	for i := range keys {
+		keys[i] = i
+		c.Add(i, i)
+	}
+
+	b.Run("loop", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				res := make(map[interface{}]interface{}, len(keys))
+				for _, key := range keys {
+					if v, ok := c.Get(key); ok {
+						res[key] = v
+					}
+				}
+			}
+		})
+	})
+	b.Run("batch", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				c.GetMany(keys)
+			}
+		})
+	})
+}
+
+// batches are added concurrently, as in BenchmarkGetMany
+func BenchmarkAddMany(b *testing.B) {
+	pairs := make(map[interface{}]interface{})
+	for i := 0; i < 1000; i++ {
+		pairs[fmt.Sprint(i)] = i
+	}
+
+	b.Run("loop", func(b *testing.B) {
+		c := cache.New(cache.WithShards(16))
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				for key, val := range pairs {
+					c.Add(key, val)
+				}
+			}
+		})
+	})
+	b.Run("batch", func(b *testing.B) {
+		c := cache.New(cache.WithShards(16))
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				c.AddMany(pairs)
+			}
+		})
+	})
+}
@@ -0,0 +1,67 @@
+package cache
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrBreakerOpen is returned by GetOrCompute and GetOrComputeMulti instead of
+// calling the loader while the circuit breaker is open. See
+// WithLoaderCircuitBreaker.
+var ErrBreakerOpen = errors.New("cache: loader circuit breaker is open")
+
+// breaker stops calls to a failing loader. It is closed while the loader
+// succeeds, opens after threshold consecutive failures and, once cooldown has
+// elapsed, lets a single probe call through (half-open). The breaker closes
+// again if the probe succeeds and reopens if it fails.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int       // consecutive failures
+	openedAt time.Time // when the breaker opened, zero if it's closed
+	probing  bool      // whether the probe call is in flight
+}
+
+// allow reports whether the loader may be called, returning ErrBreakerOpen if
+// not. If it returns nil, done must be called with the result of the loader.
+// A nil breaker always allows the call.
+func (b *breaker) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.openedAt.IsZero() {
+		return nil
+	}
+	if b.probing || time.Since(b.openedAt) < b.cooldown {
+		return ErrBreakerOpen
+	}
+	b.probing = true
+	return nil
+}
+
+// done records the outcome of a loader call allowed by allow
+func (b *breaker) done(err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		b.failures = 0
+		b.openedAt = time.Time{}
+		b.probing = false
+		return
+	}
+	b.failures++
+	if b.probing || b.failures >= b.threshold {
+		b.openedAt = time.Now()
+		b.probing = false
+	}
+}
@@ -5,8 +5,11 @@ import (
 	"encoding/binary"
 	"encoding/gob"
 	"fmt"
+	"hash"
 	"hash/fnv"
-	"strconv"
+	"math/rand"
+	"reflect"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -16,12 +19,75 @@ import (
 // value is a cache with no max number of entries and no TTU. It is safe
 // for concurrent use
 type Cache struct {
-	cap int           // the capacity. If 0, there is no limit
-	ttu time.Duration // time-to-use. If 0, no expiration time.
+	// the longest per-entry TTU ever set, see AddManaged, the number of loads
+	// in flight, the last insertion sequence number and the number of entries.
+	// They're kept first so they're 64-bit aligned for atomic access.
+	maxEntryTTU int64
+	inFlight    int64  // loads in flight, see InFlightCount
+	seq         uint64 // the last sequence number given to a new entry
+	entries     int64  // the number of entries, only kept with a total capacity
+
+	cap      int           // the capacity. If 0, there is no limit
+	totalCap int           // the capacity of the whole cache, see WithTotalCapacity
+	maxBytes int64         // the size of the whole cache, see WithMaxBytes
+	ttu      time.Duration // time-to-use. If 0, no expiration time.
+
+	fixedTTL time.Duration // time-to-live since the value was set, see WithFixedTTL
+	coolOff  time.Duration // how long used entries stay put, see WithCoolOff
 
 	nshards int32    // number of shards to use
 	shards  []*shard // the shards
 
+	validate  func(key, value interface{}) bool // validates entries on Get
+	protectAt int                               // accesses to protect an entry, see WithProtectHot
+
+	trackContention bool   // whether to count contended shard locks
+	fallback        Source // consulted on misses, see WithFallback
+
+	equal         func(old, new interface{}) bool // detects no-op updates, see WithEqualityFunc
+	policy        Policy                          // how to pick entries to evict
+	hasPriorities int32                           // set once entries have priorities, see AddWithPriority
+	hasValidators int32                           // set once entries have validators, see AddWithValidator
+
+	manualEviction bool // see WithManualEviction
+	disabled       bool // whether the cache stores nothing, see WithDisabled
+	lenientGet     bool // whether Get treats unhashable keys as misses
+
+	breaker     *breaker                                         // guards calls to loaders, see WithLoaderCircuitBreaker
+	maxInFlight int                                              // max loads in flight, see WithMaxInFlight
+	capObserver func(shardIdx int)                               // see WithCapacityObserver
+	onEvict     func(key, value interface{}, reason EvictReason) // see WithOnEvict
+	coster      func(key, value interface{}) int64               // sizes entries, see WithCoster
+	admission   CostAdmission                                    // see WithCostAdmission
+	admitFrac   float64                                          // the most of a shard's budget to evict, under AdmitReject
+
+	closeHandler func(entries []Element) // see WithCloseHandler
+	closeOnce    sync.Once
+	regName      string // the name of the cache in the registry, see WithRegistration
+
+	purgeMu   sync.Mutex
+	lastPurge PurgeStats // see LastPurgeStats
+
+	logger      Logger       // see WithLogger
+	imbalance   float64      // the shard imbalance to log, see WithImbalanceDetection
+	logSampling int          // max evictions logged per second, see WithEvictionLogSampling
+	evictLog    *evictionLog // logs evictions, if there's a logger
+
+	copier  func(value interface{}) interface{} // see WithCopier
+	history *history                            // recent evictions, see WithEvictionHistory
+
+	seed       uint64 // the hash seed, if seeded
+	seeded     bool   // whether keys are hashed with seed, see WithHashSeed
+	randomSeed bool   // whether to pick a random seed, see WithRandomSeed
+
+	rndMu sync.Mutex
+	rnd   *rand.Rand // the source of randomness, see WithRand
+
+	hasDeps      int32                                    // set once dependencies are recorded
+	depMu        sync.Mutex                               // protects the following fields
+	dependents   map[interface{}]map[interface{}]struct{} // the keys depending on each key
+	dependencies map[interface{}][]interface{}            // the keys each key depends on
+
 	mu sync.RWMutex // protects the following fields
 }
 
@@ -32,10 +98,42 @@ type Byter interface {
 	Bytes() []byte
 }
 
+// Source is implemented by anything values can be retrieved from by key, such
+// as another Cache or a client of a remote cache. See WithFallback.
+type Source interface {
+	Get(key interface{}) (value interface{}, ok bool)
+}
+
 // cacheEntry keeps the keyval and the last used time
 type cacheEntry struct {
-	key, val interface{}
-	lu       time.Time // last used time
+	key, val    interface{}
+	lu          time.Time     // last used time
+	created     time.Time     // when the value was set, see WithFixedTTL
+	ttu         time.Duration // the entry's own TTU, if not 0, see AddManaged
+	accessCount uint64        // number of times the entry was read
+	protected   bool          // whether the entry is in the protected segment
+	priority    Priority      // see AddWithPriority
+	seq         uint64        // insertion order, breaks ties between equal lu
+	size        int64         // in bytes, see WithMaxBytes
+	expAt       time.Time     // when it expires at the earliest, see expHeap
+	expIdx      int           // index in the expiration heap, or -1
+
+	onRemove func(key, value interface{})       // see AddWithCallback
+	reduce   func(full interface{}) interface{} // see AddReducible
+	reduced  bool                               // whether val was reduced
+	isErr    bool                               // whether val is an error, see AddError
+
+	valid func(value interface{}, age time.Duration) bool // see AddWithValidator
+
+	next, prev *cacheEntry // links to the neighbors in the list
+	list       *entryList  // the list the entry is in, if any
+}
+
+// usedBefore reports whether ce was last used before o. Entries with the same
+// last used time, such as entries added in bulk, are ordered by insertion, so
+// that the first one inserted is considered the least recently used.
+func (ce *cacheEntry) usedBefore(o *cacheEntry) bool {
+	return ce.lu.Before(o.lu) || ce.lu.Equal(o.lu) && ce.seq < o.seq
 }
 
 // New creates a new cache with the provided max number of entries and ttl.
@@ -45,15 +143,56 @@ func New(opts ...Option) *Cache {
 	for _, o := range opts {
 		o.apply(c)
 	}
+	if c.randomSeed {
+		c.seed, c.seeded = c.random(), true
+	}
+	c.splitTotalCap()
+	if c.logger != nil {
+		c.evictLog = &evictionLog{l: c.logger, perSecond: c.logSampling}
+	}
 
 	c.shards = make([]*shard, c.nshards)
 	for i := range c.shards {
-		c.shards[i] = newShard(c)
+		c.shards[i] = newShard(c, i)
 	}
+	c.register()
 
 	return c
 }
 
+// hasExpiry reports whether entries of the cache can expire, and therefore
+// whether purging it can ever remove anything. Caller must hold the mutex of a
+// shard or the cache.
+func (c *Cache) hasExpiry() bool {
+	return c.ttu != time.Duration(0) || c.fixedTTL != time.Duration(0) ||
+		atomic.LoadInt64(&c.maxEntryTTU) != 0
+}
+
+// entryTTU returns the TTU that applies to an entry. Caller must hold the
+// mutex of a shard or the cache.
+func (c *Cache) entryTTU(ce *cacheEntry) time.Duration {
+	if ce.ttu != 0 {
+		return ce.ttu
+	}
+	return c.ttu
+}
+
+// allShards returns the shards of the cache. The shards never change once the
+// cache is initialized, so the result may be used without holding the mutex,
+// which allows removal callbacks to call back into the cache.
+func (c *Cache) allShards() []*shard {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.shards
+}
+
+// runCallbacks runs the removal callbacks collected by unlockDeferring
+func runCallbacks(callbacks *[]func()) {
+	for _, fn := range *callbacks {
+		fn()
+	}
+}
+
 // init ensures the object is initialized
 func (c *Cache) init() {
 	if atomic.LoadInt32(&c.nshards) != 0 {
@@ -62,7 +201,7 @@ func (c *Cache) init() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	if c.nshards == 0 {
-		c.shards = []*shard{newShard(c)}
+		c.shards = []*shard{newShard(c, 0)}
 		atomic.StoreInt32(&c.nshards, 1)
 	}
 }
@@ -76,17 +215,58 @@ func (c *Cache) Len() int {
 
 	l := 0
 	for i := range c.shards {
-		l += c.shards[i].l.Len()
+		l += c.shards[i].len()
 	}
 
 	return l
 }
 
 // Cap returns the capacity of this cache
-func (c *Cache) Cap() int { return c.cap }
+func (c *Cache) Cap() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cap
+}
+
+// SetCapacity changes the capacity of the cache at runtime. Like WithCapacity,
+// cap is the capacity of each shard, and 0 means no limit. A total capacity,
+// see WithTotalCapacity, is replaced by cap. If shards hold more than cap
+// entries, their least recently used entries, or whichever the eviction policy
+// picks, are evicted right away, counting as evictions.
+func (c *Cache) SetCapacity(cap int) {
+	c.init()
+
+	var callbacks []func()
+	defer runCallbacks(&callbacks)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, s := range c.shards {
+		s.Lock()
+		defer s.unlockDeferring(&callbacks)
+	}
+
+	c.cap, c.totalCap = cap, 0
+	c.recount()
+	if cap <= 0 || c.manualEviction {
+		return
+	}
+	for _, s := range c.shards {
+		n := 0
+		for ; s.count() > cap; n++ {
+			s.evict(s.victim())
+		}
+		if n > 0 {
+			s.overflowed()
+		}
+	}
+}
 
 // TTU returns the time-to-use of the cache
-func (c *Cache) TTU() time.Duration { return c.ttu }
+func (c *Cache) TTU() time.Duration {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.ttu
+}
 
 // Add adds the new keyval pair to the cache. If the key is already present, it
 // is updated
@@ -95,73 +275,1124 @@ func (c *Cache) Add(key, val interface{}) {
 	c.shard(key).add(key, val)
 }
 
+// AddWithCallback is like Add, but onRemove is called with the key and value of
+// the entry once it's removed from the cache, whether it expired, was evicted
+// or was removed explicitly. Adding the key again with Add only replaces the
+// value, and keeps the callback; adding it with AddWithCallback replaces both.
+//
+// The callback is called after the locks of the cache are released, on the
+// goroutine that caused the removal, so it may use the cache.
+func (c *Cache) AddWithCallback(key, val interface{}, onRemove func(key, value interface{})) {
+	c.init()
+	s := c.shard(key)
+	s.Lock()
+	defer s.Unlock()
+
+	s.set(key, val)
+	if ce, found := s.idx[key]; found {
+		ce.onRemove = onRemove
+	}
+}
+
+// AddWithValidator is like Add, but every time Get finds the entry, it calls
+// valid with its value and age, the time since the value was added. If valid
+// returns false, the entry is treated as expired: it's removed and Get reports
+// a miss. This allows the validity of entries to depend on their contents or on
+// external state, entry by entry, where WithReadValidator applies to all of
+// them. Adding the key again with Add only replaces the value, and keeps the
+// validator; adding it with AddWithValidator replaces both.
+//
+// As with WithReadValidator, only Get consults the validator, which is called
+// without holding any of the cache's locks, so it may use the cache.
+func (c *Cache) AddWithValidator(key, val interface{}, valid func(value interface{}, age time.Duration) bool) {
+	c.init()
+	atomic.StoreInt32(&c.hasValidators, 1)
+
+	s := c.shard(key)
+	s.Lock()
+	defer s.Unlock()
+
+	s.set(key, val)
+	if ce, found := s.idx[key]; found {
+		ce.valid = valid
+	}
+}
+
+// AddError caches err as the result of key, for callers that cache failures as
+// well as values, such as failed lookups in a backing store that shouldn't be
+// retried until the entry expires. GetResult returns err as an error rather
+// than as a value; Get returns it as the value. Adding the key again with Add
+// replaces the error with a value.
+func (c *Cache) AddError(key interface{}, err error) {
+	c.init()
+	s := c.shard(key)
+	s.Lock()
+	defer s.Unlock()
+
+	s.set(key, err)
+	if ce, found := s.idx[key]; found {
+		ce.isErr = true
+	}
+}
+
+// GetResult is like Get, but if key has an error result, see AddError, it's
+// returned as err, with a nil value. Otherwise err is nil.
+func (c *Cache) GetResult(key interface{}) (value interface{}, err error, ok bool) {
+	c.init()
+	value, isErr, ok := c.shard(key).getResult(key)
+	if !ok {
+		return nil, nil, false
+	}
+	if err, ok := value.(error); ok && isErr {
+		return nil, err, true
+	}
+	return c.copy(value), nil, true
+}
+
+// Expire makes the entry of key expire immediately, and returns whether it was
+// in the cache and hadn't expired yet. Like the entries marked by Invalidate,
+// it's a miss for Get but still served by GetStale until it's purged, at which
+// point removal callbacks are called with ReasonExpired. Since entries with no
+// TTU or fixed TTL never expire, Expire has no effect on them and returns
+// false; use Remove instead. Entries that depend on key, see AddWithDeps, are
+// removed.
+func (c *Cache) Expire(key interface{}) bool {
+	c.init()
+	if !c.shard(key).expire(key) {
+		return false
+	}
+	c.removeDependents(key)
+	return true
+}
+
+// Touch marks key as used, as Get does, without returning its value, which
+// renews its TTU and moves it to the front of the LRU order. It returns whether
+// key was in the cache and hadn't expired. This keeps entries such as sessions
+// alive on a heartbeat without copying their values.
+func (c *Cache) Touch(key interface{}) bool {
+	c.init()
+	return c.shard(key).touch(key)
+}
+
+// GetWithExpiration is like Get, but it also returns when the entry expires
+// unless it's used again, which accounts for the TTU of the cache or the
+// entry's own, see AddWithTTU, and for the fixed TTL, see WithFixedTTL. Since
+// getting the entry counts as a use, the time is as of this call. A zero
+// expiresAt means the entry never expires. Like GetResult, it doesn't consult
+// the read validators or the fallback.
+func (c *Cache) GetWithExpiration(key interface{}) (value interface{}, expiresAt time.Time, ok bool) {
+	c.init()
+	value, expiresAt, ok = c.shard(key).getWithExpiration(key)
+	if ok {
+		value = c.copy(value)
+	}
+	return value, expiresAt, ok
+}
+
+// AddN is like Add, but it also returns the number of entries that were evicted
+// to make room for the new one. This is a cheap way to keep track of eviction
+// pressure, one operation at a time.
+func (c *Cache) AddN(key, val interface{}) (evicted int) {
+	c.init()
+	return c.shard(key).add(key, val)
+}
+
+// AddReturningOld is like Add, but it also returns the value that was replaced
+// and whether there was one. Since this is done in a single operation, unlike
+// calling Get before Add, no other update can happen in between. The value of
+// an entry that expired but wasn't purged yet is returned as well.
+func (c *Cache) AddReturningOld(key, val interface{}) (oldVal interface{}, existed bool) {
+	c.init()
+	return c.shard(key).addReturningOld(key, val)
+}
+
 // Remove removes an entry from the cache from its key. It returns the cached
 // value or nil if not present.
 func (c *Cache) Remove(key interface{}) interface{} {
 	c.init()
-	return c.shard(key).remove(key)
+	val := c.shard(key).remove(key)
+	c.removeDependents(key)
+	return val
+}
+
+// Rename moves the entry of oldKey to newKey, keeping its value and last used
+// time, and returns whether oldKey was found. If newKey is already in the
+// cache, its entry is replaced. Both keys are locked for the whole operation,
+// so no other operation sees the entry under both keys, or under neither.
+//
+// When the keys are in different shards, the entry loses its protection, see
+// WithProtectHot, and, should the new shard be full or over its byte budget, see
+// WithMaxBytes, its least recently used entries are evicted, which may include
+// the renamed entry itself.
+func (c *Cache) Rename(oldKey, newKey interface{}) bool {
+	c.init()
+
+	var callbacks []func()
+	defer runCallbacks(&callbacks)
+
+	i, j := c.shardIndex(c.hash(oldKey)), c.shardIndex(c.hash(newKey))
+	from, to := c.shards[i], c.shards[j]
+	// lock in index order so that concurrent renames can't deadlock
+	if i > j {
+		to.Lock()
+		defer to.unlockDeferring(&callbacks)
+	}
+	from.Lock()
+	defer from.unlockDeferring(&callbacks)
+	if i < j {
+		to.Lock()
+		defer to.unlockDeferring(&callbacks)
+	}
+
+	ce, found := from.idx[oldKey]
+	if !found || oldKey == newKey {
+		return found
+	}
+	if old, found := to.idx[newKey]; found {
+		to.removeElement(old, ReasonRemoved)
+	}
+
+	delete(from.idx, oldKey)
+	c.forget(oldKey)
+	ce.key = newKey
+	if from == to {
+		from.idx[newKey] = ce
+		from.recost(ce)
+		from.evictOverBytes()
+		return true
+	}
+
+	from.list(ce).Remove(ce)
+	from.bytes -= ce.size
+	from.unscheduleExpiry(ce)
+	ce.protected = false
+	to.idx[newKey] = to.l.PushFront(ce)
+	to.bytes += ce.size
+	to.scheduleExpiry(ce)
+	to.reorder(ce)
+	to.recost(ce)
+	if c.cap > 0 && !c.manualEviction && to.count() > c.cap {
+		to.removeOldest()
+		to.overflowed()
+	}
+	to.evictOverBytes()
+	return true
 }
 
 // Get retrieves an element from the cache. It also returns a second value
 // indicating whether the key was found
 func (c *Cache) Get(key interface{}) (value interface{}, ok bool) {
 	c.init()
-	return c.shard(key).get(key)
+	var s *shard
+	if c.lenientGet {
+		if s, ok = c.tryShard(key); !ok {
+			return nil, false // the key can't be in the cache
+		}
+	} else {
+		s = c.shard(key)
+	}
+	return c.getFrom(s, key)
+}
+
+// GetByHash is like Get, but it finds the shard of key from hash rather than by
+// hashing key, which saves the hashing when the caller already has the hash,
+// for instance when looking up the same set of keys repeatedly. The hash must
+// be the one returned by HashKey for key: with any other, key is looked up in
+// the wrong shard, where it isn't found even if it's in the cache. Hashes
+// depend on the hash seed, see WithHashSeed, so they can't be shared between
+// caches with different seeds.
+func (c *Cache) GetByHash(hash uint32, key interface{}) (value interface{}, ok bool) {
+	c.init()
+	return c.getFrom(c.shards[c.shardIndex(hash)], key)
+}
+
+// getFrom looks up key, which must belong to s, as Get does
+func (c *Cache) getFrom(s *shard, key interface{}) (value interface{}, ok bool) {
+	if c.validate != nil || atomic.LoadInt32(&c.hasValidators) != 0 {
+		value, ok = s.getValid(key, c.validate)
+	} else {
+		value, ok = s.get(key)
+	}
+
+	if !ok && c.fallback != nil {
+		if value, ok = c.fallback.Get(key); ok {
+			c.Add(key, value)
+		}
+	}
+	if ok {
+		value = c.copy(value)
+	}
+	return value, ok
+}
+
+// Replay runs a sequence of accesses through the cache, in order, as if each
+// key was looked up with Get and, when missing, added with the value returned
+// by loader. This leaves the cache in the state the access pattern would have
+// led to, with frequently used entries kept and others evicted, which is more
+// realistic than adding entries directly when warming up a cache or preparing
+// it for a benchmark.
+func (c *Cache) Replay(accesses []interface{}, loader func(key interface{}) interface{}) {
+	for _, key := range accesses {
+		if _, ok := c.Get(key); !ok {
+			c.Add(key, loader(key))
+		}
+	}
+}
+
+// UpdateFunc replaces the value of every live entry for which pred returns
+// true with the result of calling update with it, and returns the number of
+// entries updated. Each shard is locked while its entries are examined, so
+// nothing else can change an entry between pred and update, but pred and
+// update must not use the cache. Updating an entry doesn't count as a use.
+// Updated entries are sized again by the coster, see WithCoster, and shards
+// they take over their byte budget evict entries until they're within it.
+func (c *Cache) UpdateFunc(pred func(key, value interface{}) bool, update func(value interface{}) interface{}) int {
+	c.init()
+
+	n := 0
+	for _, s := range c.allShards() {
+		n += s.updateFunc(pred, update)
+	}
+	return n
+}
+
+// TryGet is like Get, but it waits at most maxWait for the lock of key's shard.
+// If the shard stays locked, for instance by a long purge, it gives up and
+// returns with timedOut set, so that the caller can go to the source of the
+// value instead. This bounds the time a lookup spends waiting on the cache. If
+// timeouts are frequent, the shards are contended, and the cache would likely
+// benefit from more shards, see WithShards and WithContentionTracking.
+//
+// Unlike Get, TryGet doesn't consult the read validator nor the fallback
+// source, which could block for longer than maxWait.
+func (c *Cache) TryGet(key interface{}, maxWait time.Duration) (value interface{}, ok, timedOut bool) {
+	c.init()
+	s := c.shard(key)
+	if !s.tryLockFor(maxWait) {
+		return nil, false, true
+	}
+	value, ok = s.lookup(key)
+	s.Unlock()
+
+	if !ok {
+		atomic.AddUint64(&s.misses, 1)
+		return nil, false, false
+	}
+	atomic.AddUint64(&s.hits, 1)
+	return c.copy(value), true, false
+}
+
+// GetAndUpdate replaces the value of key with the result of calling update with
+// the current value, and returns the new value. It counts as a use of the entry
+// and resets its time-to-use, as if the new value had just been added. The
+// lookup, the call to update and the store all happen under the lock of key's
+// shard, so update must not call into the cache. If key isn't in the cache,
+// update isn't called and ok is false.
+func (c *Cache) GetAndUpdate(key interface{}, update func(value interface{}) interface{}) (newValue interface{}, ok bool) {
+	c.init()
+	newValue, ok = c.shard(key).getAndUpdate(key, update)
+	if ok {
+		newValue = c.copy(newValue)
+	}
+	return newValue, ok
+}
+
+// Immutable is implemented by values that are never modified once added to the
+// cache. The cache returns such values as they are, without copying them, even
+// if it's configured with a copier. Modifying a value that claims to be
+// immutable is a programmer error, with undefined results.
+type Immutable interface {
+	// Immutable is a marker method; it's never called
+	Immutable()
+}
+
+// copy returns the copy of value to hand out to callers, if the cache has a
+// copier and value isn't Immutable
+func (c *Cache) copy(value interface{}) interface{} {
+	if c.copier == nil {
+		return value
+	}
+	if _, ok := value.(Immutable); ok {
+		return value
+	}
+	return c.copier(value)
+}
+
+// Peek is like Get, but it doesn't count as a use of the entry: its position in
+// the LRU order and its last used time are left alone, so peeking neither saves
+// an entry from eviction nor renews its TTU. The fallback source, if any, isn't
+// consulted.
+func (c *Cache) Peek(key interface{}) (value interface{}, ok bool) {
+	c.init()
+	s := c.shard(key)
+	s.Lock()
+	value, ok = s.peek(key)
+	s.Unlock()
+	if ok {
+		value = c.copy(value)
+	}
+	return value, ok
+}
+
+// Contains reports whether key is in the cache and hasn't expired. Like Peek, it
+// doesn't count as a use of the entry.
+func (c *Cache) Contains(key interface{}) bool {
+	c.init()
+	s := c.shard(key)
+	s.Lock()
+	defer s.Unlock()
+	_, ok := s.peek(key)
+	return ok
+}
+
+// Keys returns the keys of the entries in the cache that haven't expired. Keys
+// are grouped by shard, and the keys of each shard are ordered from the most to
+// the least recently used. There's no particular order between shards.
+func (c *Cache) Keys() []interface{} {
+	c.init()
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var keys []interface{}
+	for _, s := range c.shards {
+		keys = append(keys, s.keys()...)
+	}
+	return keys
+}
+
+// Range calls f for each entry of the cache that hasn't expired, until f
+// returns false. Shards are locked one at a time and f is called with the lock
+// of the entry's shard held, so f must not use the cache, or it may deadlock;
+// entries that f needs to act upon can be collected and handled once Range
+// returns. Entries of a shard are visited from the most to the least recently
+// used, with no particular order between shards, and since shards are visited
+// one after the other, Range doesn't see the cache at a single point in time
+// if it's being modified. Like Peek, calling f doesn't count as a use of the
+// entries.
+func (c *Cache) Range(f func(key, value interface{}) bool) {
+	c.init()
+	for _, s := range c.allShards() {
+		if !s.rangeEntries(func(key, value interface{}) bool {
+			return f(key, c.copy(value))
+		}) {
+			return
+		}
+	}
+}
+
+// RangeParallel calls fn for each entry of the cache that hasn't expired,
+// spreading the shards over up to concurrency goroutines, which speeds up
+// scans of large caches with many shards. Each goroutine locks one shard at a
+// time and calls fn for its entries with the lock held, so fn is called
+// concurrently and must be safe for concurrent use, and it must not use the
+// cache. RangeParallel returns once fn has been called for all entries.
+// Like Peek, calling fn doesn't count as a use of the entries.
+func (c *Cache) RangeParallel(concurrency int, fn func(key, value interface{})) {
+	c.init()
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	shards := make(chan *shard)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for s := range shards {
+				s.rangeEntries(func(key, value interface{}) bool {
+					fn(key, c.copy(value))
+					return true
+				})
+			}
+		}()
+	}
+	for _, s := range c.allShards() {
+		shards <- s
+	}
+	close(shards)
+	wg.Wait()
+}
+
+// ValuesOfType returns the values of the cache that are of the same dynamic
+// type as sample and haven't expired, which is handy for maintenance of caches
+// holding values of several types. For instance, ValuesOfType((*Session)(nil))
+// returns all *Session values. Shards are locked one at a time, so the result
+// isn't a snapshot of the cache at a single point in time if it's being
+// modified. Like Peek, this doesn't count as a use of the entries.
+func (c *Cache) ValuesOfType(sample interface{}) []interface{} {
+	c.init()
+
+	t := reflect.TypeOf(sample)
+	var values []interface{}
+	for _, s := range c.allShards() {
+		s.rangeEntries(func(key, value interface{}) bool {
+			if reflect.TypeOf(value) == t {
+				values = append(values, value)
+			}
+			return true
+		})
+	}
+	for i, v := range values {
+		values[i] = c.copy(v)
+	}
+	return values
+}
+
+// SetLastUsed sets the time key was last used to t, and returns whether the key
+// was found. The entry is moved in the LRU order according to its new last used
+// time; among entries with the same last used time, the ones added first are
+// considered less recently used. This allows aging entries manually, which is
+// mostly useful in tests of code that depends on expiration.
+//
+// Since entries expire once they haven't been used for longer than the TTU,
+// setting a time far enough in the past immediately expires the entry.
+func (c *Cache) SetLastUsed(key interface{}, t time.Time) bool {
+	c.init()
+	return c.shard(key).setLastUsed(key, t)
+}
+
+// IsEvictionCandidate reports whether key is the next entry to be evicted from
+// its shard, that is, whether it's the shard's least recently used entry. This
+// is only meaningful for caches with a capacity, as entries of other caches are
+// never evicted to make room for others.
+func (c *Cache) IsEvictionCandidate(key interface{}) bool {
+	c.init()
+	return c.shard(key).isBack(key)
+}
+
+// GetInto copies the value of key, which must be a []byte, into dst and returns
+// the number of bytes copied, which is the minimum of the lengths of the value
+// and dst. It returns ok = false if the key isn't found or if its value isn't
+// a []byte. This allows reading byte slices into reusable buffers without ever
+// handing out the slice held by the cache.
+//
+// The copy is made while holding the shard's lock. Unlike Get, GetInto doesn't
+// consult the read validator or the fallback.
+func (c *Cache) GetInto(key interface{}, dst []byte) (n int, ok bool) {
+	c.init()
+	return c.shard(key).getInto(key, dst)
+}
+
+// GetStale is like Get, but it also returns entries that have expired but
+// haven't been purged yet, in which case stale is true. Stale entries are
+// returned as they are: they are neither moved in the LRU order nor have their
+// last used time updated, so they remain expired.
+func (c *Cache) GetStale(key interface{}) (value interface{}, stale, ok bool) {
+	c.init()
+	value, stale, ok = c.shard(key).getStale(key)
+	if ok {
+		value = c.copy(value)
+	}
+	return value, stale, ok
+}
+
+// Invalidate marks every entry in the cache as expired without removing it.
+// Invalidated entries are misses for Get but are still served by GetStale, so
+// callers can keep using the stale values while they refresh them. They are
+// removed by the next Purge, like any other expired entry.
+//
+// Since entries in a cache with no TTU or fixed TTL never expire, Invalidate has
+// no effect on such a cache. Use Remove or TrimTo instead.
+func (c *Cache) Invalidate() {
+	c.init()
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !c.hasExpiry() {
+		return
+	}
+
+	var lu, created time.Time
+	now := time.Now()
+	ttu := c.ttu
+	if max := time.Duration(atomic.LoadInt64(&c.maxEntryTTU)); max > ttu {
+		ttu = max
+	}
+	if ttu != 0 {
+		lu = now.Add(-ttu - 1)
+	}
+	if c.fixedTTL != 0 {
+		created = now.Add(-c.fixedTTL - 1)
+	}
+	for _, s := range c.shards {
+		s.invalidate(lu, created)
+	}
+}
+
+// Clear removes all entries from the cache, which remains usable. Shards are
+// cleared one at a time, so entries added concurrently to a shard that was
+// already cleared are kept. Removal callbacks, see AddWithCallback and
+// WithOnEvict, are called for every entry, with ReasonCleared.
+func (c *Cache) Clear() {
+	c.init()
+	for _, s := range c.allShards() {
+		s.clear()
+	}
 }
 
 // Purge will remove entries that are expired
 func (c *Cache) Purge() int {
+	return c.PurgeWithBudget(0)
+}
+
+// PurgeWithBudget is like Purge, but examines at most perShard entries in each
+// shard, which bounds the time each shard stays locked. It returns the number
+// of entries removed. If perShard is 0 or less, there is no limit.
+//
+// Each shard keeps its entries that can expire in a heap ordered by expiration,
+// so purging examines the entries that are due first, whatever their order in
+// the LRU list, as is the case with a fixed TTL, see WithFixedTTL, or entries
+// with their own TTU, see AddWithTTU. A purge that runs out of budget therefore
+// resumes where it stopped the next time it is called, without having to
+// remember anything in between. Entries used since they were due according to
+// the heap are examined without being removed, which counts toward the budget.
+func (c *Cache) PurgeWithBudget(perShard int) int {
+	c.init()
+
+	st := PurgeStats{Time: time.Now()}
+	shards := c.allShards()
+	for _, s := range shards {
+		expired, examined := s.purge(perShard)
+		st.Removed += expired
+		st.Scanned += examined
+	}
+	c.notePurge(st)
+	c.checkBalance(shards)
+	return st.Removed
+}
+
+// Compact rebuilds the internal maps of the cache at their current size. Go maps
+// don't shrink as entries are deleted, so after a spike, the maps keep the
+// memory they grew to until they're rebuilt. Compact rebuilds the index of each
+// shard, along with its maps of loads in flight, see GetOrCompute, of keys
+// being refreshed, see GetWithRefresh, and of locked keys, see LockEntry,
+// locking one shard at a time. It then rebuilds the maps of dependencies, see
+// AddWithDeps, holding their lock.
+//
+// Rebuilding a map takes time proportional to its number of entries, during
+// which its lock is held, so Compact is meant to be called occasionally, such
+// as after the cache shrank significantly.
+func (c *Cache) Compact() {
+	c.init()
+
+	for _, s := range c.allShards() {
+		s.compact()
+	}
+
+	c.depMu.Lock()
+	defer c.depMu.Unlock()
+	if c.dependents != nil {
+		dependents := make(map[interface{}]map[interface{}]struct{}, len(c.dependents))
+		for key, deps := range c.dependents {
+			dependents[key] = deps
+		}
+		c.dependents = dependents
+		dependencies := make(map[interface{}][]interface{}, len(c.dependencies))
+		for key, deps := range c.dependencies {
+			dependencies[key] = deps
+		}
+		c.dependencies = dependencies
+	}
+}
+
+// Close removes all entries from the cache. If the cache has a close handler,
+// see WithCloseHandler, it's called with the entries that hadn't expired, once
+// they're removed. Only the first call to Close does anything; later calls are
+// no-ops, even if entries were added since.
+//
+// Close also removes the cache from the registry, see WithRegistration. It
+// doesn't stop the purgers started for the cache, whose stop functions must
+// still be called.
+func (c *Cache) Close() {
+	c.init()
+	c.closeOnce.Do(c.close)
+}
+
+func (c *Cache) close() {
+	c.unregister()
+
+	var callbacks []func()
+	defer runCallbacks(&callbacks)
+
+	var entries []Element
+	func() {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		for _, s := range c.shards {
+			s.Lock()
+			defer s.unlockDeferring(&callbacks)
+		}
+		for _, s := range c.shards {
+			entries = s.removeAll(entries)
+		}
+	}()
+
+	if c.closeHandler != nil {
+		c.closeHandler(entries)
+	}
+}
+
+// Evict removes entries from shards that are over capacity until they are
+// within it, then, if the cache is still over its total capacity, see
+// WithTotalCapacity, from each shard in turn until it's within it, choosing
+// the entries to remove according to the eviction policy. It returns the
+// number of entries removed.
+//
+// This is only useful for caches created with WithManualEviction, as other
+// caches never exceed their capacity.
+func (c *Cache) Evict() int {
+	c.init()
+
+	removed := 0
+	for _, s := range c.allShards() {
+		removed += s.evictOverflow()
+	}
+	if c.totalCap > 0 {
+		removed += c.evictOverTotal()
+	}
+	return removed
+}
+
+// TrimTo removes the least recently used entries, across all shards, until the
+// cache holds at most n entries. It returns the number of entries removed.
+// Entries with the same last used time, such as entries added in bulk, are
+// removed in the order they were added.
+//
+// Unlike the capacity, which bounds the cache at all times, this is a one-off
+// shrink that doesn't affect how many entries the cache may hold afterwards.
+func (c *Cache) TrimTo(n int) int {
 	c.init()
 
+	var callbacks []func()
+	defer runCallbacks(&callbacks)
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	expired := 0
+
+	l := 0
 	for _, s := range c.shards {
-		expired += s.purge()
+		s.Lock()
+		defer s.unlockDeferring(&callbacks)
+		l += s.count()
+	}
+
+	return c.trim(l, n)
+}
+
+// trim removes the globally least recently used entries until at most n of
+// the l entries of the cache are left, and returns how many it removed.
+// Caller must hold the locks of all shards.
+func (c *Cache) trim(l, n int) int {
+	removed := 0
+	for ; l > n && l > 0; l-- {
+		// the globally least recently used entry is the oldest of the
+		// shards' least recently used ones
+		var oldest *shard
+		var oce *cacheEntry
+		for _, s := range c.shards {
+			ce := s.oldest()
+			if ce == nil {
+				continue
+			}
+			if oldest == nil || ce.usedBefore(oce) {
+				oldest, oce = s, ce
+			}
+		}
+		oldest.removeOldest()
+		removed++
+	}
+	return removed
+}
+
+// Element describes an entry of the cache
+type Element struct {
+	Key      interface{}
+	Value    interface{}
+	LastUsed time.Time // when the entry was last used, see OldestLU
+
+	// AccessCount is the number of times the entry was read. It's reset
+	// when the entry is demoted from the protected segment, see
+	// WithProtectHot, and wraps around past the maximum uint64, which
+	// won't happen in practice.
+	AccessCount uint64
+
+	TTU time.Duration // the entry's own TTU, see AddManaged, or 0
+}
+
+// element returns the description of an entry
+func (ce *cacheEntry) element() Element {
+	return Element{Key: ce.key, Value: ce.val, LastUsed: ce.lu, AccessCount: ce.accessCount, TTU: ce.ttu}
+}
+
+// GetEntry returns the entry of key, with its metadata, if it's in the cache
+// and hasn't expired. Like Peek, it doesn't count as a use of the entry, so the
+// entry can be inspected without changing it.
+func (c *Cache) GetEntry(key interface{}) (Element, bool) {
+	c.init()
+	e, ok := c.shard(key).entry(key)
+	if ok {
+		e.Value = c.copy(e.Value)
+	}
+	return e, ok
+}
+
+// Export returns the entries of the cache that haven't expired, with their
+// metadata, so that the cache can be rebuilt elsewhere with Import, or
+// compared with another. Entries are grouped by shard, and the entries of each
+// shard are ordered from the least to the most recently used, with the
+// protected ones, see WithProtectHot, last. Shards are locked one at a time, so
+// the result isn't a snapshot of the cache at a single point in time if it's
+// being modified. Like Peek, this doesn't count as a use of the entries.
+func (c *Cache) Export() []Element {
+	c.init()
+
+	var entries []Element
+	for _, s := range c.allShards() {
+		entries = s.export(entries)
+	}
+	for i := range entries {
+		entries[i].Value = c.copy(entries[i].Value)
+	}
+	return entries
+}
+
+// Import adds entries, as returned by Export, to the cache, keeping their last
+// used times, access counts and TTUs. Entries are added in order, replacing
+// existing entries with the same key and evicting others as needed, and take
+// their place in the LRU order according to their last used times, entries
+// with the same last used time keeping the order they're listed in. Since
+// Export lists entries from the least to the most recently used, importing them
+// into a cache with the same number of shards and hash seed restores the LRU
+// order of every shard. Fixed TTLs, see WithFixedTTL, start over from the time
+// of the import.
+func (c *Cache) Import(entries []Element) {
+	c.init()
+	for _, e := range entries {
+		if e.TTU > 0 {
+			c.noteEntryTTU(e.TTU)
+		}
+		c.shard(e.Key).restore(e, time.Time{})
+	}
+}
+
+// EntryAtRank returns the entry at the given position of a shard's eviction
+// order, where rank 0 is the entry that would be evicted last, that is, the
+// most recently used one. If the shard or the rank doesn't exist, ok is false.
+// In caches using WithProtectHot, protected entries rank before all others.
+//
+// This is meant for debugging and testing; it walks the shard's entries up to
+// rank, and reading it doesn't count as using the entry.
+func (c *Cache) EntryAtRank(shardIdx, rank int) (e Element, ok bool) {
+	c.init()
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if shardIdx < 0 || shardIdx >= len(c.shards) || rank < 0 {
+		return Element{}, false
+	}
+	return c.shards[shardIdx].entryAtRank(rank)
+}
+
+// OldestLU returns the last used time of the least recently used entry in the
+// cache, or the zero time if the cache is empty. Entries that have expired but
+// weren't purged yet are taken into account.
+//
+// Since entries are kept in recency order, this only needs to look at one
+// entry per shard.
+func (c *Cache) OldestLU() time.Time {
+	c.init()
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var lu time.Time
+	for _, s := range c.shards {
+		if t, _, ok := s.lastUsed(); ok && (lu.IsZero() || t.Before(lu)) {
+			lu = t
+		}
+	}
+	return lu
+}
+
+// NewestLU returns the last used time of the most recently used entry in the
+// cache, or the zero time if the cache is empty.
+func (c *Cache) NewestLU() time.Time {
+	c.init()
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var lu time.Time
+	for _, s := range c.shards {
+		if _, t, ok := s.lastUsed(); ok && t.After(lu) {
+			lu = t
+		}
+	}
+	return lu
+}
+
+// swapMu serializes calls to Swap so that two caches being swapped with each
+// other from different goroutines can't deadlock
+var swapMu sync.Mutex
+
+// Swap atomically exchanges the entries, capacity, byte budget and TTU of c and
+// other. This allows a replacement cache to be populated in the background and then put in
+// place of c, without having to update every reference to c.
+//
+// All shards of both caches are locked while swapping, so no operation on
+// either cache observes a partially swapped state. When both caches have the
+// same number of shards and hash seed this is just an exchange of the shards'
+// contents. Otherwise, entries are rehashed into their new shards, which takes
+// time proportional to the number of entries; the recency order of the entries
+// is preserved and, should a shard end up over capacity, its least recently
+// used entries are evicted.
+//
+// Dependencies between entries, see AddWithDeps, move along with the entries.
+// The shard count and other options are not swapped.
+func (c *Cache) Swap(other *Cache) {
+	if c == other {
+		return
+	}
+	c.init()
+	other.init()
+
+	var callbacks []func()
+	defer runCallbacks(&callbacks)
+	swapMu.Lock()
+	defer swapMu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	other.mu.Lock()
+	defer other.mu.Unlock()
+	for _, s := range append(c.shards[:len(c.shards):len(c.shards)], other.shards...) {
+		s.Lock()
+		defer s.unlockDeferring(&callbacks)
+	}
+
+	c.cap, other.cap = other.cap, c.cap
+	c.totalCap, other.totalCap = other.totalCap, c.totalCap
+	c.maxBytes, other.maxBytes = other.maxBytes, c.maxBytes
+	c.splitTotalCap()
+	other.splitTotalCap()
+	c.ttu, other.ttu = other.ttu, c.ttu
+	if c.prioritized() || other.prioritized() {
+		atomic.StoreInt32(&c.hasPriorities, 1)
+		atomic.StoreInt32(&other.hasPriorities, 1)
+	}
+	if atomic.LoadInt32(&c.hasValidators) != 0 || atomic.LoadInt32(&other.hasValidators) != 0 {
+		atomic.StoreInt32(&c.hasValidators, 1)
+		atomic.StoreInt32(&other.hasValidators, 1)
+	}
+	// the max TTUs only ever grow, since entries may be added concurrently
+	max, otherMax := atomic.LoadInt64(&c.maxEntryTTU), atomic.LoadInt64(&other.maxEntryTTU)
+	c.noteEntryTTU(time.Duration(otherMax))
+	other.noteEntryTTU(time.Duration(max))
+	c.swapDeps(other)
+
+	if c.nshards == other.nshards && c.seeded == other.seeded && c.seed == other.seed {
+		for i := range c.shards {
+			c.shards[i].swap(other.shards[i])
+		}
+	} else {
+		ours, theirs := c.drain(), other.drain()
+		c.load(theirs)
+		other.load(ours)
+	}
+	c.recount()
+	other.recount()
+}
+
+// splitTotalCap sets the capacity of each shard from the total capacity, if
+// there is one, rounding up so that the shards can hold it all
+func (c *Cache) splitTotalCap() {
+	if c.totalCap > 0 {
+		n := int(c.nshards)
+		c.cap = (c.totalCap + n - 1) / n
+	}
+}
+
+// evictOverTotal evicts entries from each shard in turn until the cache is
+// within its total capacity, and returns how many were evicted. Caller must
+// not hold the lock of any shard.
+func (c *Cache) evictOverTotal() int {
+	n := 0
+	for _, s := range c.allShards() {
+		s.Lock()
+		for atomic.LoadInt64(&c.entries) > int64(c.totalCap) && s.count() > 0 {
+			s.evict(s.victim())
+			n++
+		}
+		s.Unlock()
+	}
+	return n
+}
+
+// recount updates the number of entries of the cache, if it keeps it, and
+// evicts the least recently used entries beyond the total capacity. Caller
+// must hold the locks of all shards.
+func (c *Cache) recount() {
+	if c.totalCap <= 0 {
+		atomic.StoreInt64(&c.entries, 0)
+		return
+	}
+	n := 0
+	for _, s := range c.shards {
+		n += s.count()
+	}
+	atomic.StoreInt64(&c.entries, int64(n))
+	if !c.manualEviction {
+		c.trim(n, c.totalCap)
+	}
+}
+
+// drain removes all entries from the cache and returns them ordered from the
+// least to the most recently used. Caller must hold the locks of all shards.
+func (c *Cache) drain() []*cacheEntry {
+	var ces []*cacheEntry
+	for _, s := range c.shards {
+		for _, l := range []*entryList{s.l, s.prot} {
+			for ce := l.Back(); ce != nil; ce = ce.Prev() {
+				ce.protected = false
+				ce.expIdx = -1
+				ces = append(ces, ce)
+			}
+			l.Init()
+		}
+		s.idx = make(map[interface{}]*cacheEntry)
+		s.bytes = 0
+		s.exp = nil
+	}
+	sort.SliceStable(ces, func(i, j int) bool { return ces[i].usedBefore(ces[j]) })
+	return ces
+}
+
+// load adds entries, ordered from the least to the most recently used, to the
+// cache and enforces its capacity. Caller must hold the locks of all shards.
+func (c *Cache) load(ces []*cacheEntry) {
+	if c.disabled {
+		return
+	}
+	for _, ce := range ces {
+		s := c.shard(ce.key)
+		s.idx[ce.key] = s.l.PushFront(ce)
+		s.bytes += ce.size
+		s.scheduleExpiry(ce)
+	}
+	if c.cap > 0 && !c.manualEviction {
+		for _, s := range c.shards {
+			if s.count() <= c.cap {
+				continue
+			}
+			for s.count() > c.cap {
+				s.removeOldest()
+			}
+			s.overflowed()
+		}
+	}
+	if c.maxBytes > 0 && !c.manualEviction {
+		for _, s := range c.shards {
+			if s.bytes <= c.shardBytes() {
+				continue
+			}
+			for s.bytes > c.shardBytes() {
+				s.removeOldest()
+			}
+			s.overflowed()
+		}
 	}
-	return expired
 }
 
 // StartPurger is a helper function that starts a goroutine to periodically call
 // Purge() at the provided freq. The returned stop function must be called to
 // stop the purger, otherwise the garbage collector will not be able to free it
-// and it will "leak".
+// and it will "leak". It's safe to call stop more than once.
 //
 // Also, the freq can have a detrimental effect on performance as the purger
 // must lock the entire cache while it purges the cache. Since the Cache will
 // ignore expired items, the need for frequent purges is greatly reduced.
+//
+// Each purger has its own goroutine and ticker. Programs with many caches may
+// prefer to purge them all from a single PurgeScheduler.
 func (c *Cache) StartPurger(freq time.Duration) (stop func()) {
+	return c.StartPurgerFunc(freq, nil)
+}
+
+// StartPurgerFunc is like StartPurger, but onPurge, if not nil, is called with
+// the number of entries removed by each purge, for instance to report purge
+// activity as a metric. It's called on the purger's goroutine, after every
+// purge, including the ones that removed nothing.
+func (c *Cache) StartPurgerFunc(freq time.Duration, onPurge func(n int)) (stop func()) {
+	c.init()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !c.hasExpiry() {
+		return func() {} // we don't need a purger if we don't have expiration
+	}
+
+	return every(freq, func() {
+		n := c.Purge()
+		if onPurge != nil {
+			onPurge(n)
+		}
+	})
+}
+
+// StartRollingPurger is like StartPurger, but rather than purging the whole
+// cache at every tick, it purges a single shard, visiting the shards in turn.
+// Every shard is thus purged once every nshards ticks, and each tick only locks
+// one shard and does a fraction of the work. This smooths out the cost of
+// purging large, sharded caches.
+func (c *Cache) StartRollingPurger(freq time.Duration) (stop func()) {
 	c.init()
 	c.mu.RLock()
 	defer c.mu.RUnlock()
-	if c.ttu == time.Duration(0) {
+	if !c.hasExpiry() {
 		return func() {} // we don't need a purger if we don't have expiration
 	}
 
+	next := 0 // only ever used by the purger goroutine
+	return every(freq, func() {
+		c.mu.RLock()
+		s := c.shards[next]
+		c.mu.RUnlock()
+		st := PurgeStats{Time: time.Now()}
+		st.Removed, st.Scanned = s.purge(0)
+		c.notePurge(st)
+		next = (next + 1) % len(c.shards)
+	})
+}
+
+// every starts a goroutine that calls fn at the provided freq until the
+// returned stop function is called, which is safe to call more than once
+func every(freq time.Duration, fn func()) (stop func()) {
 	ticker := time.NewTicker(freq)
-	done := make(chan bool)
+	done := make(chan struct{})
 	go func() {
 		for {
 			select {
 			case <-done:
 				return
 			case <-ticker.C:
-				c.Purge()
+				fn()
 			}
 		}
 	}()
 
+	// closing done rather than sending on it never blocks, even if the
+	// goroutine is gone, and once makes stopping more than once harmless
+	var once sync.Once
 	stopFn := func() {
-		ticker.Stop()
-		done <- true
+		once.Do(func() {
+			ticker.Stop()
+			close(done)
+		})
 	}
 
 	return stopFn
 }
 
-// length of int in bytes
-var il = strconv.IntSize / 8
-
 // stringer is implemented by any value that has a String method. The String
 // method should return a string representation of the value. This internal
 // interface is here only to avoid a dependency to fmt.Stringer
@@ -169,9 +1400,102 @@ type stringer interface {
 	String() string
 }
 
+// ShardIndex returns the index of the shard that key is assigned to.
+//
+// The assignment depends only on the key, the number of shards and the hash
+// seed, if any, so the same key always maps to the same shard for a given shard
+// count and seed. The underlying hash is stable across processes, platforms and
+// versions of this package for keys of the basic types, []byte, Byter and
+// Stringer. Keys of other types are hashed through their gob encoding, which is
+// only guaranteed to be stable within a single process.
+func (c *Cache) ShardIndex(key interface{}) int {
+	c.init()
+	return c.shardIndex(c.hash(key))
+}
+
+// HashKey returns the hash of key that the cache uses to assign it to a shard,
+// see GetByHash. Like the assignment, the hash is stable under the conditions
+// described in ShardIndex.
+func (c *Cache) HashKey(key interface{}) uint32 {
+	return c.hash(key)
+}
+
+// HashSeed returns the seed keys are hashed with, and whether the cache is
+// seeded at all. See WithHashSeed.
+func (c *Cache) HashSeed() (seed uint64, ok bool) {
+	return c.seed, c.seeded
+}
+
+// shardIndex maps a key hash to a shard index. Masking the hash is cheaper than
+// taking its modulo and gives the same result when the number of shards is a
+// power of two, but with any other number it would leave some shards unused.
+func (c *Cache) shardIndex(h uint32) int {
+	n := uint32(c.nshards)
+	if n&(n-1) == 0 {
+		return int(h & (n - 1))
+	}
+	return int(h % n)
+}
+
 func (c *Cache) shard(key interface{}) *shard {
+	return c.shards[c.shardIndex(c.hash(key))]
+}
+
+// tryShard is like shard, but reports keys that can't be hashed instead of
+// panicking
+func (c *Cache) tryShard(key interface{}) (s *shard, ok bool) {
+	defer func() {
+		if recover() != nil {
+			s, ok = nil, false
+		}
+	}()
+	return c.shard(key), true
+}
+
+// hash computes the hash of key used to assign it to a shard
+func (c *Cache) hash(key interface{}) uint32 {
+	if c.seeded {
+		return seededHashKey(c.seed, key)
+	}
+	return hashKey(key)
+}
+
+// hashKey computes the 32-bit FNV-1a hash of a byte representation of key.
+// Changing the way keys are hashed changes their shard assignment, so this
+// must be kept stable.
+func hashKey(key interface{}) uint32 {
 	h := fnv.New32a() // used to hash a byte array
+	writeKey(h, key)
+	return h.Sum32()
+}
 
+// seededHashKey computes the 64-bit FNV-1a hash of seed followed by a byte
+// representation of key, and folds it into 32 bits after mixing it so that
+// every bit of the result depends on the seed. As with hashKey, this must be
+// kept stable so that saved seeds keep producing the same assignments.
+func seededHashKey(seed uint64, key interface{}) uint32 {
+	h := fnv.New64a()
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], seed)
+	h.Write(b[:])
+	writeKey(h, key)
+	x := fmix64(h.Sum64())
+	return uint32(x) ^ uint32(x>>32)
+}
+
+// fmix64 is the finalizer of MurmurHash3, which makes each bit of the result
+// depend on every bit of the input
+func fmix64(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// writeKey writes a byte representation of key to h
+func writeKey(h hash.Hash, key interface{}) {
 	// try to get a bytes representation of the key any way we can, in order
 	// from fastest to slowest
 	switch v := key.(type) {
@@ -204,8 +1528,6 @@ func (c *Cache) shard(key interface{}) *shard {
 		}
 		h.Write(buf.Bytes())
 	}
-
-	return c.shards[h.Sum32()&uint32(c.nshards-1)]
 }
 
 func toBytes(v interface{}) []byte {
@@ -216,18 +1538,17 @@ func toBytes(v interface{}) []byte {
 	return buf.Bytes()
 }
 
-// helper function to quickly turn an int into a byte slice
+// helper function to quickly turn an int into a byte slice. Ints are always
+// encoded as 8 bytes so that their hash doesn't depend on the platform.
 func intBytes(i int) []byte {
-	b := make([]byte, il)
+	b := make([]byte, 8)
 	b[0] = byte(i)
 	b[1] = byte(i >> 8)
 	b[2] = byte(i >> 16)
 	b[3] = byte(i >> 24)
-	if il == 8 {
-		b[4] = byte(i >> 32)
-		b[5] = byte(i >> 40)
-		b[6] = byte(i >> 48)
-		b[7] = byte(i >> 56)
-	}
+	b[4] = byte(int64(i) >> 32)
+	b[5] = byte(int64(i) >> 40)
+	b[6] = byte(int64(i) >> 48)
+	b[7] = byte(int64(i) >> 56)
 	return b
 }
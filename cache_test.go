@@ -1,8 +1,13 @@
 package cache_test
 
 import (
+	"errors"
 	"fmt"
 	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -79,6 +84,1901 @@ func TestCache_GetExpired(t *testing.T) {
 	}
 }
 
+func TestCache_Peek(t *testing.T) {
+	c := cache.New(cache.WithCapacity(2))
+	c.Add(1, 1)
+	c.Add(2, 2)
+	for i := 0; i < 3; i++ {
+		if v, ok := c.Peek(1); !ok || v != 1 {
+			t.Fatalf("got %v, %v; want 1, true", v, ok)
+		}
+	}
+	c.Add(3, 3) // still evicts 1, the oldest
+
+	if _, ok := c.Peek(1); ok {
+		t.Error("peeked entry wasn't evicted")
+	}
+	if v, ok := c.Peek(2); !ok || v != 2 {
+		t.Errorf("got %v, %v; want 2, true", v, ok)
+	}
+}
+
+func TestCache_Contains(t *testing.T) {
+	c := cache.New(cache.WithCapacity(2), cache.WithTTU(time.Hour))
+	c.Add(1, 1)
+	c.Add(2, 2)
+	if !c.Contains(1) || c.Contains(3) {
+		t.Fatal("Contains doesn't match the entries")
+	}
+	c.Add(3, 3) // still evicts 1, the oldest
+	if c.Contains(1) {
+		t.Error("entry checked with Contains wasn't evicted")
+	}
+
+	c.Invalidate()
+	if c.Contains(2) {
+		t.Error("Contains found an expired entry")
+	}
+}
+
+func TestCache_Keys(t *testing.T) {
+	c := cache.New(cache.WithShards(4))
+	for i := 0; i < 10; i++ {
+		c.Add(i, i)
+	}
+	c.AddWithTTU(10, 10, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+
+	keys := c.Keys()
+	sort.Slice(keys, func(i, j int) bool { return keys[i].(int) < keys[j].(int) })
+	if want := []interface{}{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("got keys %v, want %v", keys, want)
+	}
+
+	// within a shard, keys are ordered from the most recently used
+	c = cache.New()
+	c.Add(1, 1)
+	c.Add(2, 2)
+	c.Get(1)
+	if keys, want := c.Keys(), []interface{}{1, 2}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("got keys %v, want %v", keys, want)
+	}
+}
+
+func TestCache_Range(t *testing.T) {
+	c := cache.New(cache.WithShards(4))
+	for i := 0; i < 10; i++ {
+		c.Add(i, i)
+	}
+	c.AddWithTTU(10, 10, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+
+	sum, n := 0, 0
+	c.Range(func(key, value interface{}) bool {
+		if key == 10 {
+			t.Error("visited an expired entry")
+		}
+		sum += value.(int)
+		n++
+		return true
+	})
+	if sum != 45 || n != 10 {
+		t.Errorf("visited %d entries summing %d, want 10 and 45", n, sum)
+	}
+
+	n = 0
+	c.Range(func(key, value interface{}) bool {
+		n++
+		return n < 3
+	})
+	if n != 3 {
+		t.Errorf("visited %d entries, want 3 before stopping", n)
+	}
+}
+
+func TestCache_ShardIndex(t *testing.T) {
+	// these are pinned so that any change to the way keys are hashed, which
+	// would change the shard assignment of existing keys, is caught
+	tests := []struct {
+		key  interface{}
+		want int
+	}{
+		{"hello", 11},
+		{42, 15},
+		{[]byte("bytes"), 4},
+		{int64(-7), 11},
+		{uint16(9), 12},
+	}
+
+	c := cache.New(cache.WithShards(16))
+	for _, test := range tests {
+		for i := 0; i < 3; i++ {
+			if got := c.ShardIndex(test.key); got != test.want {
+				t.Errorf("ShardIndex(%v): got %d, want %d", test.key, got, test.want)
+			}
+		}
+		// the assignment must not depend on the cache instance
+		if got := cache.New(cache.WithShards(16)).ShardIndex(test.key); got != test.want {
+			t.Errorf("ShardIndex(%v) on new cache: got %d, want %d", test.key, got, test.want)
+		}
+	}
+}
+
+func TestWithShardsNotPowerOfTwo(t *testing.T) {
+	for _, n := range []int32{3, 10, 100} {
+		c := cache.New(cache.WithShards(n))
+		for i := 0; i < 100*int(n); i++ {
+			c.Add(i, i)
+		}
+		for i := 0; i < int(n); i++ {
+			if c.ShardLen(i) == 0 {
+				t.Errorf("shard %d of %d is empty", i, n)
+			}
+		}
+	}
+}
+
+func TestWithHashSeed(t *testing.T) {
+	// seeded assignments are pinned too, so that saved seeds keep working
+	tests := []struct {
+		key  interface{}
+		want int
+	}{
+		{"hello", 6},
+		{42, 1},
+		{[]byte("bytes"), 8},
+		{int64(-7), 7},
+		{uint16(9), 7},
+	}
+
+	c := cache.New(cache.WithShards(16), cache.WithHashSeed(0x5eed))
+	for _, test := range tests {
+		if got := c.ShardIndex(test.key); got != test.want {
+			t.Errorf("ShardIndex(%v): got %d, want %d", test.key, got, test.want)
+		}
+	}
+	if seed, ok := c.HashSeed(); !ok || seed != 0x5eed {
+		t.Errorf("got seed %x, %v; want 5eed, true", seed, ok)
+	}
+
+	// a different seed must give a different assignment
+	d := cache.New(cache.WithShards(16), cache.WithRandomSeed())
+	same := 0
+	for i := 0; i < 100; i++ {
+		if c.ShardIndex(i) == d.ShardIndex(i) {
+			same++
+		}
+	}
+	if same > 50 {
+		t.Errorf("%d of 100 keys have the same shard with different seeds", same)
+	}
+	if _, ok := d.HashSeed(); !ok {
+		t.Error("random seed isn't reported")
+	}
+	if _, ok := cache.New().HashSeed(); ok {
+		t.Error("unseeded cache reports a seed")
+	}
+}
+
+func TestWithRand(t *testing.T) {
+	seed := func() uint64 {
+		c := cache.New(cache.WithRandomSeed(), cache.WithRand(rand.New(rand.NewSource(42))))
+		s, _ := c.HashSeed()
+		return s
+	}
+	if a, b := seed(), seed(); a != b {
+		t.Errorf("got seeds %x and %x from the same source", a, b)
+	}
+}
+
+func TestCache_TrimTo(t *testing.T) {
+	c := cache.New(cache.WithShards(4))
+	for i := 0; i < 100; i++ {
+		c.Add(i, i)
+	}
+
+	if n := c.TrimTo(10); n != 90 {
+		t.Errorf("got %d removed, want 90", n)
+	}
+	if c.Len() != 10 {
+		t.Errorf("got len() %d, want 10", c.Len())
+	}
+	// only the 10 most recently used entries should be left
+	for i := 90; i < 100; i++ {
+		if _, ok := c.Get(i); !ok {
+			t.Errorf("key %d was trimmed", i)
+		}
+	}
+
+	if n := c.TrimTo(20); n != 0 {
+		t.Errorf("got %d removed, want 0", n)
+	}
+	if n := c.TrimTo(0); n != 10 || c.Len() != 0 {
+		t.Errorf("got %d removed and len() %d, want 10 and 0", n, c.Len())
+	}
+}
+
+func TestCache_Invalidate(t *testing.T) {
+	c := cache.New(cache.WithTTU(time.Hour), cache.WithShards(4))
+	for i := 0; i < 10; i++ {
+		c.Add(i, i)
+	}
+
+	c.Invalidate()
+	if c.Len() != 10 {
+		t.Errorf("got len() %d, want 10", c.Len())
+	}
+	for i := 0; i < 10; i++ {
+		if _, ok := c.Get(i); ok {
+			t.Errorf("got a hit for invalidated key %d", i)
+		}
+		v, stale, ok := c.GetStale(i)
+		if !ok || !stale || v != i {
+			t.Errorf("GetStale(%d): got %v, %v, %v; want %d, true, true", i, v, stale, ok, i)
+		}
+	}
+
+	// refreshed entries are fresh again
+	c.Add(1, 100)
+	if v, stale, ok := c.GetStale(1); !ok || stale || v != 100 {
+		t.Errorf("GetStale(1): got %v, %v, %v; want 100, false, true", v, stale, ok)
+	}
+
+	if n := c.Purge(); n != 9 {
+		t.Errorf("got %d purged, want 9", n)
+	}
+	if _, _, ok := c.GetStale(2); ok {
+		t.Error("purged entry is still served stale")
+	}
+}
+
+func TestCache_InvalidateEntryTTU(t *testing.T) {
+	c := cache.New()
+	c.Add("x", 1)
+	c.SetLastUsed("x", time.Now().Add(-time.Hour))
+	c.AddWithTTU("y", 2, 10*time.Minute)
+	c.Get("x") // moves x in front of y
+
+	c.Invalidate()
+	if _, ok := c.Get("y"); ok {
+		t.Error("got a hit for invalidated key y")
+	}
+	if v, stale, ok := c.GetStale("y"); !ok || !stale || v != 2 {
+		t.Errorf("GetStale(y): got %v, %v, %v; want 2, true, true", v, stale, ok)
+	}
+}
+
+func TestCache_Stats(t *testing.T) {
+	c := cache.New(cache.WithCapacity(2), cache.WithTTU(time.Hour))
+	c.Add(1, 1)
+	c.Add(2, 2)
+	c.Add(3, 3) // evicts 1
+	c.Get(1)
+	c.Get(2)
+	c.Get(3)
+	c.Invalidate()
+	c.Purge()
+
+	want := cache.Stats{Hits: 2, Misses: 1, Evictions: 1, Expirations: 2}
+	if got := c.Stats(); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestCache_ResetStats(t *testing.T) {
+	c := cache.New(cache.WithCapacity(1), cache.WithShards(2))
+	c.Add(1, 1)
+	c.Add(2, 2)
+	c.Add(3, 3)
+	c.Get(3)
+	c.Get(4)
+	c.ResetStats()
+
+	want := cache.Stats{Entries: uint64(c.Len())}
+	if got := c.Stats(); got != want {
+		t.Errorf("got %+v after reset, want %+v", got, want)
+	}
+	c.Get(3)
+	if got := c.Stats().Hits; got != 1 {
+		t.Errorf("got %d hits, want 1", got)
+	}
+}
+
+func TestCache_ShardStatsDetail(t *testing.T) {
+	c := cache.New(cache.WithShards(4))
+	c.Add("a", 1)
+	c.Get("a")
+	c.Get("b")
+
+	st := c.ShardStatsDetail()
+	if len(st) != 4 {
+		t.Fatalf("got %d shards, want 4", len(st))
+	}
+	a, b := c.ShardIndex("a"), c.ShardIndex("b")
+	want := make([]cache.ShardStat, 4)
+	want[a].Entries++
+	want[a].Hits++
+	want[b].Misses++
+	for i := range st {
+		if st[i] != want[i] {
+			t.Errorf("shard %d: got %+v, want %+v", i, st[i], want[i])
+		}
+	}
+}
+
+func TestCache_ShardLen(t *testing.T) {
+	c := cache.New(cache.WithShards(4))
+	for i := 0; i < 100; i++ {
+		c.Add(i, i)
+	}
+
+	total := 0
+	for i := 0; i < 4; i++ {
+		total += c.ShardLen(i)
+	}
+	if total != 100 {
+		t.Errorf("shard lengths add up to %d, want 100", total)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("no panic for an out of range shard")
+		}
+	}()
+	c.ShardLen(4)
+}
+
+func TestCache_CountBy(t *testing.T) {
+	c := cache.New(cache.WithShards(4))
+	for _, k := range []string{"acme/1", "acme/2", "acme/3", "initech/1", "globex/1", "globex/2"} {
+		c.Add(k, true)
+	}
+
+	got := c.CountBy(func(key interface{}) string {
+		return strings.SplitN(key.(string), "/", 2)[0]
+	})
+	want := map[string]int{"acme": 3, "initech": 1, "globex": 2}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestWithReadValidator(t *testing.T) {
+	revoked := map[interface{}]bool{"bob": true}
+	c := cache.New(cache.WithReadValidator(func(key, value interface{}) bool {
+		return !revoked[key]
+	}))
+	c.Add("alice", "admin")
+	c.Add("bob", "admin")
+
+	if v, ok := c.Get("alice"); !ok || v != "admin" {
+		t.Errorf("got %v, %v; want admin, true", v, ok)
+	}
+	if _, ok := c.Get("bob"); ok {
+		t.Error("got a hit for an invalid entry")
+	}
+	if c.Len() != 1 {
+		t.Errorf("got len() %d, want 1", c.Len())
+	}
+}
+
+func TestCache_Swap(t *testing.T) {
+	for _, shards := range []int32{1, 4} {
+		c := cache.New(cache.WithCapacity(100), cache.WithShards(4))
+		c.Add("old", 1)
+
+		other := cache.New(cache.WithTTU(time.Hour), cache.WithShards(shards))
+		for i := 0; i < 10; i++ {
+			other.Add(i, i)
+		}
+
+		c.Swap(other)
+		if c.Len() != 10 || other.Len() != 1 {
+			t.Errorf("%d shards: got len() %d and %d, want 10 and 1", shards, c.Len(), other.Len())
+		}
+		if c.Cap() != 0 || c.TTU() != time.Hour {
+			t.Errorf("%d shards: got cap %d and TTU %v, want 0 and 1h", shards, c.Cap(), c.TTU())
+		}
+		if other.Cap() != 100 || other.TTU() != 0 {
+			t.Errorf("%d shards: got other's cap %d and TTU %v, want 100 and 0", shards, other.Cap(), other.TTU())
+		}
+		for i := 0; i < 10; i++ {
+			if v, ok := c.Get(i); !ok || v != i {
+				t.Errorf("%d shards: Get(%d): got %v, %v", shards, i, v, ok)
+			}
+		}
+		if _, ok := other.Get("old"); !ok {
+			t.Errorf("%d shards: old entry wasn't swapped into other", shards)
+		}
+	}
+}
+
+func TestCache_SwapEntryTTUAndDeps(t *testing.T) {
+	c, other := cache.New(), cache.New()
+	other.AddWithTTU("k", 1, 10*time.Millisecond)
+	other.Add("base", 2)
+	other.AddWithDeps("dependent", 3, "base")
+
+	c.Swap(other)
+	c.Remove("base")
+	if _, ok := c.Get("dependent"); ok {
+		t.Error("dependent survived the removal of its base after Swap")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := c.Get("k"); ok {
+		t.Error("got a hit for an entry whose TTU ran out after Swap")
+	}
+	if n := c.Purge(); n != 1 {
+		t.Errorf("got %d purged, want 1", n)
+	}
+}
+
+func TestCache_OldestNewestLU(t *testing.T) {
+	c := cache.New(cache.WithShards(4))
+	if !c.OldestLU().IsZero() || !c.NewestLU().IsZero() {
+		t.Error("empty cache reported last used times")
+	}
+
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		c.Add(i, i)
+	}
+	end := time.Now()
+
+	oldest, newest := c.OldestLU(), c.NewestLU()
+	if oldest.Before(start) || newest.After(end) || newest.Before(oldest) {
+		t.Errorf("got oldest %v and newest %v, want within [%v, %v]", oldest, newest, start, end)
+	}
+
+	c.Get(0)
+	if got := c.NewestLU(); !got.After(end) {
+		t.Errorf("got newest %v, want after %v", got, end)
+	}
+}
+
+func TestCache_StartRollingPurger(t *testing.T) {
+	c := cache.New(cache.WithTTU(10*time.Millisecond), cache.WithShards(4))
+	for i := 0; i < 100; i++ {
+		c.Add(i, i)
+	}
+
+	stop := c.StartRollingPurger(5 * time.Millisecond)
+	defer stop()
+
+	for deadline := time.Now().Add(time.Second); c.Len() > 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("got len() %d, want 0", c.Len())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestCache_StartPurgerStopTwice(t *testing.T) {
+	for _, c := range []*cache.Cache{cache.New(), cache.New(cache.WithTTU(time.Hour))} {
+		stop := c.StartPurger(time.Millisecond)
+		time.Sleep(5 * time.Millisecond)
+
+		stopped := make(chan struct{})
+		go func() {
+			stop()
+			stop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(time.Second):
+			t.Fatal("stop blocked")
+		}
+	}
+}
+
+func TestCache_StartPurgerFunc(t *testing.T) {
+	c := cache.New(cache.WithTTU(10 * time.Millisecond))
+	for i := 0; i < 100; i++ {
+		c.Add(i, i)
+	}
+
+	var mu sync.Mutex
+	purged := 0
+	stop := c.StartPurgerFunc(5*time.Millisecond, func(n int) {
+		mu.Lock()
+		purged += n
+		mu.Unlock()
+	})
+	defer stop()
+
+	for deadline := time.Now().Add(time.Second); ; {
+		mu.Lock()
+		n := purged
+		mu.Unlock()
+		if n == 100 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d entries reported purged, want 100", n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWithFixedTTL(t *testing.T) {
+	c := cache.New(cache.WithCapacity(2), cache.WithFixedTTL(50*time.Millisecond))
+	c.Add("hot", 1)
+	c.Add("cold", 2)
+	c.Get("hot")
+	c.Add("new", 3) // evicts cold, which was used less recently
+
+	if _, ok := c.Get("cold"); ok {
+		t.Error("the least recently used entry wasn't evicted")
+	}
+	for deadline := time.Now().Add(40 * time.Millisecond); time.Now().Before(deadline); {
+		if _, ok := c.Get("hot"); !ok {
+			t.Fatal("entry expired before its TTL")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	time.Sleep(15 * time.Millisecond)
+	if _, ok := c.Get("hot"); ok {
+		t.Error("reads renewed the fixed TTL")
+	}
+
+	// setting a new value renews it
+	c.Add("new", 4)
+	if _, ok := c.Get("new"); !ok {
+		t.Error("updated entry expired")
+	}
+}
+
+func TestCache_StartPurgerWithFixedTTL(t *testing.T) {
+	c := cache.New(cache.WithFixedTTL(10 * time.Millisecond))
+	for i := 0; i < 100; i++ {
+		c.Add(i, i)
+	}
+
+	stop := c.StartPurger(5 * time.Millisecond)
+	defer stop()
+
+	for deadline := time.Now().Add(time.Second); c.Len() > 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("got len() %d, want 0", c.Len())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestCache_IsEvictionCandidate(t *testing.T) {
+	c := cache.New(cache.WithCapacity(3))
+	for i := 0; i < 3; i++ {
+		c.Add(i, i)
+	}
+
+	if !c.IsEvictionCandidate(0) {
+		t.Error("least recently used entry isn't the eviction candidate")
+	}
+	c.Get(0)
+	if c.IsEvictionCandidate(0) || !c.IsEvictionCandidate(1) {
+		t.Error("eviction candidate didn't change after access")
+	}
+	if c.IsEvictionCandidate(42) {
+		t.Error("missing key reported as eviction candidate")
+	}
+}
+
+func TestWithProtectHot(t *testing.T) {
+	c := cache.New(cache.WithCapacity(5), cache.WithProtectHot(2))
+	for i := 0; i < 5; i++ {
+		c.Add(i, i)
+	}
+	// 0 is read twice, so it's protected
+	c.Get(0)
+	c.Get(0)
+
+	// a burst of new entries flushes everything but the protected entry
+	for i := 5; i < 20; i++ {
+		c.Add(i, i)
+	}
+	if c.Len() != 5 {
+		t.Errorf("got len() %d, want 5", c.Len())
+	}
+	if _, ok := c.Get(0); !ok {
+		t.Error("protected entry was evicted")
+	}
+	for i := 1; i < 5; i++ {
+		if _, ok := c.Get(i); ok {
+			t.Errorf("unprotected entry %d survived", i)
+		}
+	}
+}
+
+func TestWithContentionTracking(t *testing.T) {
+	c := cache.New(cache.WithContentionTracking(), cache.WithShards(2))
+	shardIdx := c.ShardIndex("key")
+
+	// hold the lock of the shard of key so that adding it has to wait
+	unlock := c.LockShard(shardIdx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Add("key", "value")
+	}()
+	for c.ShardContention()[shardIdx] == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	unlock()
+	<-done
+
+	counts := c.ShardContention()
+	if len(counts) != 2 {
+		t.Fatalf("got %d counts, want 2", len(counts))
+	}
+	if counts[shardIdx] != 1 || counts[1-shardIdx] != 0 {
+		t.Errorf("got contention %v, want 1 for shard %d only", counts, shardIdx)
+	}
+	if _, ok := c.Get("key"); !ok {
+		t.Error("key wasn't added once the shard was unlocked")
+	}
+
+	for _, n := range cache.New().ShardContention() {
+		if n != 0 {
+			t.Error("contention recorded without tracking")
+		}
+	}
+}
+
+func TestWithFallback(t *testing.T) {
+	remote := cache.New()
+	remote.Add("hello", "world")
+
+	c := cache.New(cache.WithFallback(remote))
+	if v, ok := c.Get("hello"); !ok || v != "world" {
+		t.Errorf("got %v, %v; want world, true", v, ok)
+	}
+	if c.Len() != 1 {
+		t.Errorf("fallback hit wasn't cached locally: got len() %d, want 1", c.Len())
+	}
+	if _, ok := c.Get("nope"); ok {
+		t.Error("got a hit for a key missing from both caches")
+	}
+
+	// once cached locally, the fallback isn't needed anymore
+	remote.Remove("hello")
+	if _, ok := c.Get("hello"); !ok {
+		t.Error("local copy wasn't used")
+	}
+}
+
+func TestWithEqualityFunc(t *testing.T) {
+	c := cache.New(cache.WithCapacity(2), cache.WithEqualityFunc(func(old, new interface{}) bool {
+		return old == new
+	}))
+	c.Add(1, "one")
+	c.Add(2, "two")
+
+	c.Add(1, "one") // no-op, so 1 is still the least recently used entry
+	if !c.IsEvictionCandidate(1) {
+		t.Error("no-op update moved the entry")
+	}
+
+	c.Add(1, "uno")
+	if c.IsEvictionCandidate(1) {
+		t.Error("update didn't move the entry")
+	}
+	if v, _ := c.Get(1); v != "uno" {
+		t.Errorf("got %v, want uno", v)
+	}
+}
+
+func TestCache_SetLastUsed(t *testing.T) {
+	c := cache.New(cache.WithTTU(time.Minute))
+	for i := 0; i < 5; i++ {
+		c.Add(i, i)
+	}
+
+	if !c.SetLastUsed(2, time.Now().Add(-time.Hour)) {
+		t.Error("SetLastUsed(2) reported a missing key")
+	}
+	if c.SetLastUsed(42, time.Now()) {
+		t.Error("SetLastUsed(42) reported an existing key")
+	}
+	if !c.IsEvictionCandidate(2) {
+		t.Error("backdated entry wasn't moved to the back")
+	}
+	if _, ok := c.Get(2); ok {
+		t.Error("got a hit for a backdated entry")
+	}
+	if n := c.Purge(); n != 1 {
+		t.Errorf("got %d purged, want 1", n)
+	}
+
+	// dating an entry forward moves it to the front
+	c.SetLastUsed(0, time.Now().Add(time.Second))
+	if got := c.NewestLU(); !got.After(time.Now()) {
+		t.Errorf("got newest %v, want in the future", got)
+	}
+	if c.IsEvictionCandidate(0) {
+		t.Error("entry dated forward wasn't moved to the front")
+	}
+}
+
+func TestCache_PurgeWithBudget(t *testing.T) {
+	c := cache.New(cache.WithTTU(time.Minute))
+	for i := 0; i < 10; i++ {
+		c.Add(i, i)
+	}
+	for i := 0; i < 5; i++ {
+		c.SetLastUsed(i, time.Now().Add(-time.Hour))
+	}
+
+	for _, want := range []int{2, 2, 1, 0} {
+		if n := c.PurgeWithBudget(2); n != want {
+			t.Errorf("got %d purged, want %d", n, want)
+		}
+	}
+	if c.Len() != 5 {
+		t.Errorf("got len() %d, want 5", c.Len())
+	}
+}
+
+func TestCache_AddReturningOld(t *testing.T) {
+	c := cache.New()
+	if old, existed := c.AddReturningOld(1, "one"); existed || old != nil {
+		t.Errorf("got %v, %v; want nil, false", old, existed)
+	}
+	if old, existed := c.AddReturningOld(1, "uno"); !existed || old != "one" {
+		t.Errorf("got %v, %v; want one, true", old, existed)
+	}
+	if v, _ := c.Get(1); v != "uno" {
+		t.Errorf("got %v, want uno", v)
+	}
+}
+
+func TestCache_GetInto(t *testing.T) {
+	c := cache.New()
+	c.Add("bytes", []byte("hello world"))
+	c.Add("string", "hello world")
+
+	buf := make([]byte, 5)
+	if n, ok := c.GetInto("bytes", buf); !ok || n != 5 || string(buf) != "hello" {
+		t.Errorf("got %d, %v, %q; want 5, true, hello", n, ok, buf)
+	}
+	buf[0] = 'j' // must not affect the cached value
+	buf = make([]byte, 20)
+	if n, ok := c.GetInto("bytes", buf); !ok || string(buf[:n]) != "hello world" {
+		t.Errorf("got %d, %v, %q; want 11, true, hello world", n, ok, buf[:n])
+	}
+
+	if _, ok := c.GetInto("string", buf); ok {
+		t.Error("got ok for a value that isn't a []byte")
+	}
+	if _, ok := c.GetInto("nope", buf); ok {
+		t.Error("got ok for a missing key")
+	}
+}
+
+func TestWithPolicyEvictNewest(t *testing.T) {
+	c := cache.New(cache.WithCapacity(3), cache.WithPolicy(cache.PolicyEvictNewest))
+	for i := 0; i < 3; i++ {
+		c.Add(i, i)
+	}
+	if !c.IsEvictionCandidate(2) {
+		t.Error("newest entry isn't the eviction candidate")
+	}
+
+	// a burst of new entries only ever replaces the previous newcomer
+	for i := 3; i < 10; i++ {
+		c.Add(i, i)
+	}
+	if c.Len() != 3 {
+		t.Errorf("got len() %d, want 3", c.Len())
+	}
+	for _, k := range []int{0, 1, 9} {
+		if _, ok := c.Get(k); !ok {
+			t.Errorf("entry %d was evicted", k)
+		}
+	}
+}
+
+func TestWithManualEviction(t *testing.T) {
+	c := cache.New(cache.WithCapacity(2), cache.WithManualEviction())
+	for i := 0; i < 5; i++ {
+		c.Add(i, i)
+	}
+	if c.Len() != 5 {
+		t.Errorf("got len() %d, want 5", c.Len())
+	}
+	if c.Cap() != 2 {
+		t.Errorf("got cap() %d, want 2", c.Cap())
+	}
+
+	if n := c.Evict(); n != 3 {
+		t.Errorf("evicted %d entries, want 3", n)
+	}
+	for i := 0; i < 5; i++ {
+		if _, ok := c.Get(i); ok != (i >= 3) {
+			t.Errorf("got ok %v for %d", ok, i)
+		}
+	}
+	if st := c.Stats(); st.Evictions != 3 {
+		t.Errorf("got %d evictions, want 3", st.Evictions)
+	}
+	if n := c.Evict(); n != 0 {
+		t.Errorf("evicted %d entries from a cache within capacity", n)
+	}
+}
+
+func TestCache_EntryAtRank(t *testing.T) {
+	c := cache.New(cache.WithProtectHot(1), cache.WithTTU(time.Hour))
+	c.Add(1, "one")
+	c.Add(2, "two")
+	c.Add(3, "three")
+	c.Get(1) // protected
+
+	for rank, want := range []int{1, 3, 2} {
+		e, ok := c.EntryAtRank(0, rank)
+		if !ok || e.Key != want {
+			t.Errorf("rank %d: got %v, %v; want %v, true", rank, e.Key, ok, want)
+		}
+	}
+	if e, _ := c.EntryAtRank(0, 1); e.Value != "three" || e.LastUsed.IsZero() {
+		t.Errorf("got %+v", e)
+	}
+	for _, r := range [][2]int{{0, 3}, {0, -1}, {1, 0}, {-1, 0}} {
+		if _, ok := c.EntryAtRank(r[0], r[1]); ok {
+			t.Errorf("got an entry for shard %d, rank %d", r[0], r[1])
+		}
+	}
+}
+
+type frozen []int
+
+func (frozen) Immutable() {}
+
+func TestWithCopier(t *testing.T) {
+	c := cache.New(cache.WithCopier(func(v interface{}) interface{} {
+		return append([]int(nil), v.([]int)...)
+	}))
+	c.Add("mutable", []int{1, 2, 3})
+	c.Add("frozen", frozen{1, 2, 3})
+
+	v, _ := c.Get("mutable")
+	v.([]int)[0] = 42
+	if v, _ := c.Get("mutable"); v.([]int)[0] != 1 {
+		t.Error("modifying a returned value changed the cached one")
+	}
+
+	v, _ = c.Get("frozen")
+	w, _ := c.Get("frozen")
+	if &v.(frozen)[0] != &w.(frozen)[0] {
+		t.Error("an immutable value was copied")
+	}
+}
+
+func TestCache_Expire(t *testing.T) {
+	var expired []interface{}
+	c := cache.New(cache.WithTTU(time.Hour), cache.WithOnEvict(func(key, value interface{}, reason cache.EvictReason) {
+		if reason == cache.ReasonExpired {
+			expired = append(expired, key)
+		}
+	}))
+	c.Add("a", 1)
+	c.Add("b", 2)
+	if !c.Expire("a") {
+		t.Fatal("couldn't expire a live entry")
+	}
+	if _, ok := c.Get("a"); ok {
+		t.Error("got an expired entry")
+	}
+	if c.Expire("a") || c.Expire("missing") {
+		t.Error("expired an expired or missing entry")
+	}
+	if n := c.Purge(); n != 1 || !reflect.DeepEqual(expired, []interface{}{"a"}) {
+		t.Errorf("purged %d entries, %v expired; want 1 and [a]", n, expired)
+	}
+	if _, ok := c.Get("b"); !ok {
+		t.Error("another entry expired")
+	}
+
+	c = cache.New()
+	c.Add("a", 1)
+	if c.Expire("a") || !c.Contains("a") {
+		t.Error("expired an entry of a cache without expiration")
+	}
+}
+
+func TestCache_Touch(t *testing.T) {
+	c := cache.New(cache.WithTTU(40 * time.Millisecond))
+	c.Add("session", 1)
+	c.Add("other", 2)
+	time.Sleep(25 * time.Millisecond)
+	if !c.Touch("session") {
+		t.Fatal("couldn't touch a live entry")
+	}
+	time.Sleep(25 * time.Millisecond)
+
+	if _, ok := c.Get("session"); !ok {
+		t.Error("touched entry expired")
+	}
+	if _, ok := c.Get("other"); ok {
+		t.Error("untouched entry didn't expire")
+	}
+	if c.Touch("other") || c.Touch("missing") {
+		t.Error("touched an expired or missing entry")
+	}
+}
+
+func TestCache_GetWithExpiration(t *testing.T) {
+	c := cache.New(cache.WithTTU(time.Hour))
+	c.Add("a", 1)
+	c.AddWithTTU("b", 2, time.Minute)
+	start := time.Now()
+
+	v, exp, ok := c.GetWithExpiration("a")
+	if !ok || v != 1 || exp.Before(start.Add(time.Hour)) || exp.After(time.Now().Add(time.Hour)) {
+		t.Errorf("got %v, %v, %v; want 1, in an hour, true", v, exp, ok)
+	}
+	if _, exp, _ := c.GetWithExpiration("b"); exp.Before(start.Add(time.Minute)) || exp.After(time.Now().Add(time.Minute)) {
+		t.Errorf("got %v, want in a minute", exp)
+	}
+	if v, exp, ok := c.GetWithExpiration("c"); ok || v != nil || !exp.IsZero() {
+		t.Errorf("got %v, %v, %v for a missing key", v, exp, ok)
+	}
+
+	c = cache.New(cache.WithCapacity(2))
+	c.Add("a", 1)
+	c.Add("b", 2)
+	if v, exp, ok := c.GetWithExpiration("a"); !ok || v != 1 || !exp.IsZero() {
+		t.Errorf("got %v, %v, %v; want 1, never, true", v, exp, ok)
+	}
+	c.Add("c", 3) // evicts b, since a was used
+	if !c.Contains("a") || c.Contains("b") {
+		t.Error("getting with the expiration didn't count as a use")
+	}
+}
+
+func TestCache_SetCapacity(t *testing.T) {
+	c := cache.New(cache.WithShards(4))
+	for i := 0; i < 100; i++ {
+		c.Add(i, i)
+	}
+	c.SetCapacity(5)
+	if c.Cap() != 5 {
+		t.Errorf("got cap %d, want 5", c.Cap())
+	}
+	for i := 0; i < 4; i++ {
+		if n := c.ShardLen(i); n > 5 {
+			t.Errorf("shard %d holds %d entries, want at most 5", i, n)
+		}
+	}
+	if !c.Contains(99) || c.Contains(0) {
+		t.Error("shrinking didn't evict the least recently used entries")
+	}
+	if st := c.Stats(); st.Evictions != uint64(100-c.Len()) {
+		t.Errorf("got %d evictions for %d entries left", st.Evictions, c.Len())
+	}
+
+	c.SetCapacity(0)
+	for i := 0; i < 100; i++ {
+		c.Add(i, i)
+	}
+	if c.Len() != 100 {
+		t.Errorf("got len %d without capacity, want 100", c.Len())
+	}
+}
+
+func TestCache_Clear(t *testing.T) {
+	var removed []interface{}
+	c := cache.New(cache.WithShards(4), cache.WithCapacity(10), cache.WithOnEvict(func(key, value interface{}, reason cache.EvictReason) {
+		if reason == cache.ReasonCleared {
+			removed = append(removed, key)
+		}
+	}))
+	for i := 0; i < 20; i++ {
+		c.Add(i, i)
+	}
+	n := c.Len()
+	c.Clear()
+	if c.Len() != 0 || len(removed) != n {
+		t.Fatalf("got len %d and %d keys cleared, want 0 and %d", c.Len(), len(removed), n)
+	}
+
+	c.Add(1, 1)
+	if v, ok := c.Get(1); !ok || v != 1 {
+		t.Errorf("got %v, %v after clearing; want 1, true", v, ok)
+	}
+	if err := c.CheckInvariants(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWithOnEvict(t *testing.T) {
+	type eviction struct {
+		key, value interface{}
+		reason     cache.EvictReason
+	}
+	var got []eviction
+	var c *cache.Cache
+	c = cache.New(cache.WithCapacity(2), cache.WithTTU(time.Hour), cache.WithOnEvict(func(key, value interface{}, reason cache.EvictReason) {
+		c.Len() // the cache can be used
+		got = append(got, eviction{key, value, reason})
+	}))
+	c.Add(1, 1)
+	c.Add(2, 2)
+	c.Add(2, 20) // replaces 2
+	c.Add(3, 3)  // evicts 1
+	c.Remove(2)
+	c.Invalidate()
+	c.Purge() // expires 3
+
+	want := []eviction{
+		{2, 2, cache.ReasonReplaced},
+		{1, 1, cache.ReasonCapacity},
+		{2, 20, cache.ReasonRemoved},
+		{3, 3, cache.ReasonExpired},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestWithEvictionHistory(t *testing.T) {
+	c := cache.New(cache.WithCapacity(2), cache.WithTTU(time.Hour), cache.WithEvictionHistory(3))
+	c.Add(1, 1)
+	c.Add(2, 2)
+	c.Add(3, 3) // evicts 1
+	c.Remove(2)
+	c.Invalidate()
+	c.Purge() // expires 3
+	c.Add(4, 4)
+	c.Remove(4)
+
+	var keys []interface{}
+	var reasons []cache.EvictReason
+	for _, ev := range c.RecentEvictions() {
+		keys = append(keys, ev.Key)
+		reasons = append(reasons, ev.Reason)
+	}
+	if want := []interface{}{2, 3, 4}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("got keys %v, want %v", keys, want)
+	}
+	if want := []cache.EvictReason{cache.ReasonRemoved, cache.ReasonExpired, cache.ReasonRemoved}; !reflect.DeepEqual(reasons, want) {
+		t.Errorf("got reasons %v, want %v", reasons, want)
+	}
+
+	if ev, ok := c.WasRecentlyEvicted(3); !ok || ev.Reason != cache.ReasonExpired || ev.Time.IsZero() {
+		t.Errorf("got %+v, %v", ev, ok)
+	}
+	if _, ok := c.WasRecentlyEvicted(1); ok {
+		t.Error("got an eviction that should have been forgotten")
+	}
+	if evs := cache.New().RecentEvictions(); len(evs) != 0 {
+		t.Errorf("got %d evictions without a history", len(evs))
+	}
+}
+
+func TestCache_Replay(t *testing.T) {
+	c := cache.New(cache.WithCapacity(2))
+
+	var loaded []interface{}
+	c.Replay([]interface{}{1, 2, 1, 3, 1}, func(key interface{}) interface{} {
+		loaded = append(loaded, key)
+		return key.(int) * 10
+	})
+
+	if want := []interface{}{1, 2, 3}; !reflect.DeepEqual(loaded, want) {
+		t.Errorf("loaded %v, want %v", loaded, want)
+	}
+	for key, want := range map[int]interface{}{1: 10, 2: nil, 3: 30} {
+		if got, _ := c.Get(key); got != want {
+			t.Errorf("got %v for %d, want %v", got, key, want)
+		}
+	}
+}
+
+func TestCache_AddN(t *testing.T) {
+	c := cache.New(cache.WithCapacity(2))
+	for i, want := range []int{0, 0, 1, 1} {
+		if got := c.AddN(i, i); got != want {
+			t.Errorf("AddN(%d): got %d evicted, want %d", i, got, want)
+		}
+	}
+	if got := c.AddN(3, "updated"); got != 0 {
+		t.Errorf("updating evicted %d entries", got)
+	}
+
+	m := cache.New(cache.WithCapacity(1), cache.WithManualEviction())
+	m.AddN(1, 1)
+	if got := m.AddN(2, 2); got != 0 {
+		t.Errorf("got %d evicted with manual eviction, want 0", got)
+	}
+}
+
+func TestCache_Rename(t *testing.T) {
+	c := cache.New(cache.WithShards(8), cache.WithTTU(time.Hour))
+
+	// find keys in the same and in different shards
+	var same, other string
+	for i := 0; same == "" || other == ""; i++ {
+		k := fmt.Sprint("key", i)
+		if c.ShardIndex(k) == c.ShardIndex("old") {
+			if same == "" && k != "old" {
+				same = k
+			}
+		} else if other == "" {
+			other = k
+		}
+	}
+
+	for _, newKey := range []string{same, other} {
+		c.Add("old", "value")
+		lu := time.Now().Add(-time.Minute).Truncate(time.Second)
+		c.SetLastUsed("old", lu)
+		c.Add(newKey, "overwritten")
+
+		if !c.Rename("old", newKey) {
+			t.Fatalf("Rename(old, %s) didn't find old", newKey)
+		}
+		if _, ok := c.Get("old"); ok {
+			t.Errorf("old is still in the cache after renaming to %s", newKey)
+		}
+		if e, _ := c.EntryAtRank(c.ShardIndex(newKey), 0); e.Key != newKey || e.Value != "value" || !e.LastUsed.Equal(lu) {
+			t.Errorf("got %+v after renaming to %s", e, newKey)
+		}
+		if c.Len() != 1 {
+			t.Errorf("got len() %d, want 1", c.Len())
+		}
+		c.Remove(newKey)
+	}
+
+	if c.Rename("missing", "other") {
+		t.Error("renamed a missing key")
+	}
+}
+
+func TestCache_ReadOnly(t *testing.T) {
+	c := cache.New(cache.WithTTU(time.Hour))
+	c.Add("a", 1)
+	c.Add("b", 2)
+	c.Add("expired", 3)
+	c.SetLastUsed("expired", time.Now().Add(-2*time.Hour))
+
+	r := c.ReadOnly()
+	if _, ok := r.(*cache.Cache); ok {
+		t.Error("the read-only view is the cache itself")
+	}
+	if v, ok := r.Get("a"); !ok || v != 1 {
+		t.Errorf("Get: got %v, %v; want 1, true", v, ok)
+	}
+	if v, ok := r.Peek("b"); !ok || v != 2 {
+		t.Errorf("Peek: got %v, %v; want 2, true", v, ok)
+	}
+	if _, ok := r.Peek("expired"); ok {
+		t.Error("Peek found an expired entry")
+	}
+	if !r.Contains("a") || r.Contains("expired") || r.Contains("missing") {
+		t.Error("Contains doesn't match the cache contents")
+	}
+	if r.Len() != 3 {
+		t.Errorf("got len() %d, want 3", r.Len())
+	}
+	if keys, want := r.Keys(), []interface{}{"a", "b"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("got keys %v, want %v", keys, want)
+	}
+}
+
+func TestCache_Invariants(t *testing.T) {
+	opts := map[string][]cache.Option{
+		"lru":       {cache.WithCapacity(8), cache.WithShards(4), cache.WithTTU(time.Hour)},
+		"no ttu":    {cache.WithCapacity(8), cache.WithShards(4)},
+		"protected": {cache.WithCapacity(8), cache.WithShards(4), cache.WithTTU(time.Hour), cache.WithProtectHot(2)},
+		"newest":    {cache.WithCapacity(8), cache.WithPolicy(cache.PolicyEvictNewest)},
+	}
+	for name, opts := range opts {
+		t.Run(name, func(t *testing.T) {
+			c := cache.New(opts...)
+			r := rand.New(rand.NewSource(1))
+			for i := 0; i < 5000; i++ {
+				key := r.Intn(50)
+				switch r.Intn(10) {
+				case 0:
+					c.Remove(key)
+				case 1:
+					c.Rename(key, r.Intn(50))
+				case 2:
+					c.SetLastUsed(key, time.Now().Add(-time.Duration(r.Intn(100))*time.Minute))
+				case 3, 4, 5:
+					c.Get(key)
+				default:
+					c.Add(key, i)
+				}
+				if err := c.CheckInvariants(); err != nil {
+					t.Fatalf("after %d operations: %v", i+1, err)
+				}
+			}
+		})
+	}
+}
+
+func TestWithDisabled(t *testing.T) {
+	c := cache.New(cache.WithDisabled())
+	c.Add(1, 1)
+	c.AddManaged(2, 2, time.Hour).Expire()
+	v, err := c.GetOrCompute(3, func(key interface{}) (interface{}, error) { return 3, nil })
+	if v != 3 || err != nil {
+		t.Errorf("GetOrCompute: got %v, %v; want 3, nil", v, err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		if _, ok := c.Get(i); ok {
+			t.Errorf("got a hit for %d", i)
+		}
+	}
+	if c.Len() != 0 {
+		t.Errorf("got len() %d, want 0", c.Len())
+	}
+}
+
+func TestCache_GetEntry(t *testing.T) {
+	c := cache.New(cache.WithProtectHot(2), cache.WithTTU(time.Hour))
+	c.Add("key", "value")
+	for i := 0; i < 5; i++ {
+		c.Get("key")
+	}
+
+	e, ok := c.GetEntry("key")
+	if !ok || e.Key != "key" || e.Value != "value" || e.AccessCount != 5 {
+		t.Errorf("got %+v, %v", e, ok)
+	}
+	if e, _ := c.GetEntry("key"); e.AccessCount != 5 {
+		t.Errorf("GetEntry counted as an access: got %d, want 5", e.AccessCount)
+	}
+	if _, ok := c.GetEntry("missing"); ok {
+		t.Error("got an entry for a missing key")
+	}
+}
+
+func TestCache_AddWithCallback(t *testing.T) {
+	c := cache.New(cache.WithCapacity(2), cache.WithTTU(time.Hour), cache.WithShards(2))
+
+	removed := map[interface{}]interface{}{}
+	onRemove := func(key, value interface{}) {
+		removed[key] = value
+		c.Len() // must not deadlock
+	}
+
+	c.AddWithCallback("expired", 1, onRemove)
+	c.Invalidate()
+	c.Purge()
+	c.AddWithCallback("removed", 2, onRemove)
+	c.Add("removed", 3) // keeps the callback
+	c.Remove("removed")
+	c.AddWithCallback("trimmed", 4, onRemove)
+	c.TrimTo(0)
+
+	want := map[interface{}]interface{}{"expired": 1, "removed": 3, "trimmed": 4}
+	if !reflect.DeepEqual(removed, want) {
+		t.Errorf("got %v, want %v", removed, want)
+	}
+}
+
+func TestCache_UpdateFunc(t *testing.T) {
+	c := cache.New(cache.WithShards(4))
+	for i := 0; i < 10; i++ {
+		c.Add(i, i)
+	}
+
+	n := c.UpdateFunc(func(key, value interface{}) bool {
+		return key.(int)%2 == 0
+	}, func(value interface{}) interface{} {
+		return value.(int) * 10
+	})
+	if n != 5 {
+		t.Errorf("updated %d entries, want 5", n)
+	}
+	for i := 0; i < 10; i++ {
+		want := i
+		if i%2 == 0 {
+			want *= 10
+		}
+		if v, _ := c.Get(i); v != want {
+			t.Errorf("got %v for %d, want %d", v, i, want)
+		}
+	}
+}
+
+func TestWithLenientGet(t *testing.T) {
+	key := struct{ F func() }{}
+
+	c := cache.New(cache.WithLenientGet())
+	if _, ok := c.Get(key); ok {
+		t.Error("got a hit for a key that can't be hashed")
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("no panic for a key that can't be hashed")
+			}
+		}()
+		cache.New().Get(key)
+	}()
+}
+
+func TestWithCapacityObserver(t *testing.T) {
+	var full []int
+	c := cache.New(cache.WithCapacity(2), cache.WithCapacityObserver(func(i int) {
+		full = append(full, i)
+	}))
+
+	for i := 0; i < 5; i++ {
+		c.Add(i, i)
+	}
+	if want := []int{0}; !reflect.DeepEqual(full, want) {
+		t.Fatalf("got %v, want %v", full, want)
+	}
+
+	c.Remove(4)
+	c.Add(5, 5) // back at capacity, but nothing is evicted
+	c.Add(6, 6)
+	if want := []int{0, 0}; !reflect.DeepEqual(full, want) {
+		t.Errorf("got %v, want %v", full, want)
+	}
+}
+
+func TestWithCapacityObserver_renameAndSwap(t *testing.T) {
+	var full []int
+	c := cache.New(cache.WithCapacity(1), cache.WithShards(2), cache.WithCapacityObserver(func(i int) {
+		full = append(full, i)
+	}))
+
+	// find keys in both shards
+	var from, to []string
+	for i := 0; len(from) < 1 || len(to) < 2; i++ {
+		k := fmt.Sprint("key", i)
+		if c.ShardIndex(k) == 0 {
+			from = append(from, k)
+		} else {
+			to = append(to, k)
+		}
+	}
+	c.Add(to[0], 0)
+	c.Add(from[0], 1)
+	c.Rename(from[0], to[1]) // evicts to[0]
+	if want := []int{1}; !reflect.DeepEqual(full, want) {
+		t.Fatalf("got %v after Rename, want %v", full, want)
+	}
+
+	// rehashed into fewer shards, with the capacity of other
+	full = nil
+	other := cache.New(cache.WithCapacity(1), cache.WithShards(4))
+	for i := 0; i < 10; i++ {
+		other.Add(i, i)
+	}
+	if other.Len() < 2 {
+		t.Fatalf("got len() %d, want entries in several shards", other.Len())
+	}
+	d := cache.New(cache.WithShards(1), cache.WithCapacityObserver(func(i int) {
+		full = append(full, i)
+	}))
+	d.Swap(other)
+	if want := []int{0}; d.Len() != 1 || !reflect.DeepEqual(full, want) {
+		t.Errorf("got len() %d and %v after Swap, want 1 and %v", d.Len(), full, want)
+	}
+}
+
+func TestCache_GetAndUpdate(t *testing.T) {
+	c := cache.New(cache.WithTTU(50 * time.Millisecond))
+	c.Add("a", 1)
+
+	called := false
+	if _, ok := c.GetAndUpdate("b", func(value interface{}) interface{} {
+		called = true
+		return value
+	}); ok || called {
+		t.Errorf("got ok=%v, called=%v for a missing key", ok, called)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	v, ok := c.GetAndUpdate("a", func(value interface{}) interface{} {
+		return value.(int) + 1
+	})
+	if !ok || v != 2 {
+		t.Fatalf("got %v, %v, want 2, true", v, ok)
+	}
+
+	time.Sleep(30 * time.Millisecond) // past the original TTU
+	if v, ok := c.Get("a"); !ok || v != 2 {
+		t.Errorf("got %v, %v, want 2, true", v, ok)
+	}
+}
+
+func TestWithCloseHandler(t *testing.T) {
+	var calls int
+	var got []interface{}
+	c := cache.New(cache.WithTTU(time.Hour), cache.WithCloseHandler(func(entries []cache.Element) {
+		calls++
+		for _, e := range entries {
+			got = append(got, e.Key)
+		}
+	}))
+	for i := 0; i < 3; i++ {
+		c.Add(i, i)
+	}
+	c.Get(0)
+	c.SetLastUsed(1, time.Now().Add(-2*time.Hour)) // expired
+
+	c.Close()
+	if want := []interface{}{2, 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if c.Len() != 0 {
+		t.Errorf("got len() %d, want 0", c.Len())
+	}
+
+	c.Add(3, 3)
+	c.Close()
+	if calls != 1 {
+		t.Errorf("handler called %d times, want 1", calls)
+	}
+}
+
+func TestCache_FillRatio(t *testing.T) {
+	if r := cache.New().FillRatio(); r != 0 {
+		t.Errorf("got %v for an unlimited cache, want 0", r)
+	}
+
+	c := cache.New(cache.WithCapacity(4), cache.WithShards(2), cache.WithManualEviction())
+	for i := 0; i < 2; i++ {
+		c.Add(i, i)
+	}
+	if r := c.FillRatio(); r != 0.25 {
+		t.Errorf("got %v, want 0.25", r)
+	}
+	for i := 2; i < 20; i++ {
+		c.Add(i, i)
+	}
+	if r := c.FillRatio(); r != 1 {
+		t.Errorf("got %v for a cache over capacity, want 1", r)
+	}
+}
+
+func TestCache_RangeParallel(t *testing.T) {
+	c := cache.New(cache.WithShards(16))
+	for i := 0; i < 1000; i++ {
+		c.Add(i, i)
+	}
+
+	serial := 0
+	for _, key := range c.Keys() {
+		v, _ := c.Peek(key)
+		serial += v.(int)
+	}
+
+	var mu sync.Mutex
+	parallel, calls := 0, 0
+	c.RangeParallel(4, func(key, value interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		parallel += value.(int)
+		calls++
+	})
+	if parallel != serial || calls != 1000 {
+		t.Errorf("got sum %d over %d entries, want %d over 1000", parallel, calls, serial)
+	}
+}
+
+func TestCache_GetResult(t *testing.T) {
+	c := cache.New()
+	errNotFound := errors.New("not found")
+	c.Add("value", 1)
+	c.Add("plain error", errNotFound) // just a value
+	c.AddError("error", errNotFound)
+
+	tests := []struct {
+		key   string
+		value interface{}
+		err   error
+		ok    bool
+	}{
+		{"value", 1, nil, true},
+		{"plain error", errNotFound, nil, true},
+		{"error", nil, errNotFound, true},
+		{"missing", nil, nil, false},
+	}
+	for _, tt := range tests {
+		value, err, ok := c.GetResult(tt.key)
+		if value != tt.value || err != tt.err || ok != tt.ok {
+			t.Errorf("got %v, %v, %v for %s; want %v, %v, %v", value, err, ok, tt.key, tt.value, tt.err, tt.ok)
+		}
+	}
+
+	c.Add("error", 2)
+	if value, err, _ := c.GetResult("error"); value != 2 || err != nil {
+		t.Errorf("got %v, %v after replacing the error; want 2, nil", value, err)
+	}
+
+	// updating the value in place replaces the error too
+	c.AddError("error", errNotFound)
+	c.GetAndUpdate("error", func(interface{}) interface{} { return 42 })
+	if value, err, _ := c.GetResult("error"); value != 42 || err != nil {
+		t.Errorf("got %v, %v after GetAndUpdate; want 42, nil", value, err)
+	}
+	c.AddError("error", errNotFound)
+	c.UpdateFunc(func(key, _ interface{}) bool { return key == "error" }, func(interface{}) interface{} { return 43 })
+	if value, err, _ := c.GetResult("error"); value != 43 || err != nil {
+		t.Errorf("got %v, %v after UpdateFunc; want 43, nil", value, err)
+	}
+}
+
+func TestCache_EqualRecencyOrder(t *testing.T) {
+	c := cache.New(cache.WithShards(4))
+	for i := 0; i < 20; i++ {
+		c.Add(i, i)
+	}
+	// make them all equally recent, as if they were added at once
+	lu := time.Now()
+	for i := 19; i >= 0; i-- {
+		c.SetLastUsed(i, lu)
+	}
+
+	c.TrimTo(10)
+	for i := 0; i < 20; i++ {
+		if got, want := c.Contains(i), i >= 10; got != want {
+			t.Errorf("got Contains(%d) = %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestCache_ValuesOfType(t *testing.T) {
+	type session struct{ id int }
+	c := cache.New(cache.WithShards(4))
+	for i := 0; i < 10; i++ {
+		if i%2 == 0 {
+			c.Add(i, &session{i})
+		} else {
+			c.Add(i, session{i}) // not a pointer
+		}
+	}
+	c.Add("s", "string")
+
+	values := c.ValuesOfType((*session)(nil))
+	var ids []int
+	for _, v := range values {
+		ids = append(ids, v.(*session).id)
+	}
+	sort.Ints(ids)
+	if want := []int{0, 2, 4, 6, 8}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("got %v, want %v", ids, want)
+	}
+	if got := c.ValuesOfType(""); !reflect.DeepEqual(got, []interface{}{"string"}) {
+		t.Errorf("got %v, want [string]", got)
+	}
+}
+
+func TestCache_TryGet(t *testing.T) {
+	c := cache.New()
+	c.Add("a", 1)
+
+	if v, ok, timedOut := c.TryGet("a", time.Millisecond); v != 1 || !ok || timedOut {
+		t.Errorf("got %v, %v, %v; want 1, true, false", v, ok, timedOut)
+	}
+	if v, ok, timedOut := c.TryGet("b", time.Millisecond); v != nil || ok || timedOut {
+		t.Errorf("got %v, %v, %v; want nil, false, false", v, ok, timedOut)
+	}
+
+	// hold the lock of the shard with a predicate that blocks
+	release := make(chan struct{})
+	blocked := make(chan struct{})
+	c = cache.New(cache.WithTTU(time.Hour))
+	c.Add("a", 1)
+	go c.UpdateFunc(func(key, value interface{}) bool {
+		close(blocked)
+		<-release
+		return false
+	}, nil)
+	<-blocked
+
+	start := time.Now()
+	if _, ok, timedOut := c.TryGet("a", 20*time.Millisecond); ok || !timedOut {
+		t.Errorf("got %v, %v; want false, true", ok, timedOut)
+	}
+	if d := time.Since(start); d < 20*time.Millisecond || d > time.Second {
+		t.Errorf("gave up after %v, want about 20ms", d)
+	}
+	close(release)
+	if v, ok, timedOut := c.TryGet("a", time.Second); v != 1 || !ok || timedOut {
+		t.Errorf("got %v, %v, %v; want 1, true, false", v, ok, timedOut)
+	}
+}
+
+func TestCache_LastPurgeStats(t *testing.T) {
+	c := cache.New(cache.WithTTU(20 * time.Millisecond))
+	if st := c.LastPurgeStats(); st != (cache.PurgeStats{}) {
+		t.Errorf("got %+v before any purge, want zero", st)
+	}
+
+	for i := 0; i < 10; i++ {
+		c.Add(i, i)
+	}
+	time.Sleep(30 * time.Millisecond)
+	for i := 10; i < 15; i++ {
+		c.Add(i, i)
+	}
+
+	start := time.Now()
+	c.Purge()
+	st := c.LastPurgeStats()
+	// entries that aren't due yet aren't examined
+	if st.Removed != 10 || st.Scanned != 10 {
+		t.Errorf("got %d removed out of %d scanned, want 10 out of 10", st.Removed, st.Scanned)
+	}
+	if st.Time.Before(start) || st.Duration <= 0 || st.Duration > time.Since(start) {
+		t.Errorf("got time %v and duration %v for a purge started at %v", st.Time, st.Duration, start)
+	}
+}
+
+func TestCache_GetByHash(t *testing.T) {
+	for _, c := range []*cache.Cache{
+		cache.New(cache.WithShards(8)),
+		cache.New(cache.WithShards(8), cache.WithHashSeed(42)),
+	} {
+		for i := 0; i < 100; i++ {
+			c.Add(i, i)
+		}
+		for i := 0; i < 100; i++ {
+			if v, ok := c.GetByHash(c.HashKey(i), i); !ok || v != i {
+				t.Errorf("got %v, %v for %d; want %d, true", v, ok, i, i)
+			}
+		}
+		if _, ok := c.GetByHash(c.HashKey(100), 100); ok {
+			t.Error("found a missing key")
+		}
+	}
+}
+
+func TestCache_ShardFillRatios(t *testing.T) {
+	if got := cache.New(cache.WithShards(2)).ShardFillRatios(); !reflect.DeepEqual(got, []float64{0, 0}) {
+		t.Errorf("got %v for an unlimited cache, want [0 0]", got)
+	}
+
+	c := cache.New(cache.WithCapacity(4), cache.WithShards(2))
+	for i, n := 0, 0; n < 3; i++ {
+		if c.ShardIndex(i) == 1 {
+			c.Add(i, i)
+			n++
+		}
+	}
+	if got, want := c.ShardFillRatios(), []float64{0, 0.75}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestCache_ExportImport(t *testing.T) {
+	src := cache.New(cache.WithTTU(time.Hour), cache.WithShards(4))
+	for i := 0; i < 10; i++ {
+		src.Add(i, i)
+	}
+	src.AddManaged("managed", "m", time.Minute)
+	old := time.Now().Add(-30 * time.Minute)
+	src.SetLastUsed(3, old)
+	src.SetLastUsed(4, time.Now().Add(-2*time.Hour)) // expired
+	src.Get(5)
+
+	entries := src.Export()
+	if len(entries) != 10 {
+		t.Fatalf("exported %d entries, want 10", len(entries))
+	}
+
+	dst := cache.New(cache.WithTTU(time.Hour), cache.WithShards(2))
+	dst.Import(entries)
+	if dst.Len() != 10 || dst.Contains(4) {
+		t.Errorf("got keys %v, want all but 4", dst.Keys())
+	}
+	want, _ := src.GetEntry(3)
+	if got, _ := dst.GetEntry(3); !got.LastUsed.Equal(old) || !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if got, _ := dst.GetEntry(5); got.AccessCount != 1 {
+		t.Errorf("got access count %d, want 1", got.AccessCount)
+	}
+	if got, _ := dst.GetEntry("managed"); got.TTU != time.Minute {
+		t.Errorf("got TTU %v, want 1m", got.TTU)
+	}
+	if err := dst.CheckInvariants(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCache_AddWithValidator(t *testing.T) {
+	c := cache.New(cache.WithEvictionHistory(10))
+	version := 1
+	var age time.Duration
+	c.AddWithValidator("a", 1, func(value interface{}, a time.Duration) bool {
+		age = a
+		return value == version
+	})
+	c.Add("b", 2)
+
+	time.Sleep(10 * time.Millisecond)
+	if v, ok := c.Get("a"); !ok || v != 1 {
+		t.Errorf("got %v, %v; want 1, true", v, ok)
+	}
+	if age < 10*time.Millisecond {
+		t.Errorf("got age %v, want at least 10ms", age)
+	}
+	if v, ok := c.Get("b"); !ok || v != 2 {
+		t.Errorf("got %v, %v; want 2, true", v, ok)
+	}
+
+	version = 2
+	if _, ok := c.Get("a"); ok {
+		t.Error("got a hit for an entry its validator rejected")
+	}
+	if c.Contains("a") {
+		t.Error("rejected entry wasn't removed")
+	}
+	if ev := c.RecentEvictions(); len(ev) != 1 || ev[0].Reason != cache.ReasonExpired {
+		t.Errorf("got evictions %v, want a single expiration", ev)
+	}
+}
+
+func TestCache_SwapValidators(t *testing.T) {
+	c, other := cache.New(), cache.New()
+	other.AddWithValidator("k", 1, func(interface{}, time.Duration) bool { return false })
+
+	c.Swap(other)
+	if _, ok := c.Get("k"); ok {
+		t.Error("got a hit for an entry its validator rejected after Swap")
+	}
+}
+
+func TestCache_Compact(t *testing.T) {
+	c := cache.New(cache.WithShards(4))
+	for i := 0; i < 1000; i++ {
+		c.AddWithDeps(i, i, i+1)
+	}
+	for i := 0; i < 990; i++ {
+		c.Remove(i)
+	}
+
+	c.Compact()
+	if c.Len() != 10 {
+		t.Fatalf("got len() %d, want 10", c.Len())
+	}
+	for i := 990; i < 1000; i++ {
+		if v, ok := c.Get(i); !ok || v != i {
+			t.Errorf("got %v, %v for %d; want %d, true", v, ok, i, i)
+		}
+	}
+	c.Remove(999)
+	if c.Contains(998) {
+		t.Error("dependencies lost by compaction")
+	}
+	if err := c.CheckInvariants(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCache_ImportOrder(t *testing.T) {
+	for _, ttu := range []time.Duration{0, time.Hour} {
+		src := cache.New(cache.WithTTU(ttu), cache.WithShards(2))
+		for i := 0; i < 10; i++ {
+			src.Add(i, i)
+		}
+		for _, i := range []int{3, 7, 0, 5} {
+			src.Get(i)
+		}
+
+		dst := cache.New(cache.WithTTU(ttu), cache.WithShards(2))
+		dst.Import(src.Export())
+		for shard := 0; shard < 2; shard++ {
+			for rank := 0; ; rank++ {
+				want, ok := src.EntryAtRank(shard, rank)
+				got, _ := dst.EntryAtRank(shard, rank)
+				if got.Key != want.Key {
+					t.Errorf("TTU %v: got %v at rank %d of shard %d, want %v", ttu, got.Key, rank, shard, want.Key)
+				}
+				if !ok {
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestWithCoolOff(t *testing.T) {
+	c := cache.New(cache.WithCoolOff(30 * time.Millisecond))
+	c.Add("hot", 1)
+	c.Add("b", 2)
+	c.Add("c", 3)
+
+	c.Get("hot") // within the cool-off since it was added
+	if e, _ := c.EntryAtRank(0, 2); e.Key != "hot" {
+		t.Errorf("got %v at the back, want hot", e.Key)
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	c.Get("hot")
+	if e, _ := c.EntryAtRank(0, 0); e.Key != "hot" {
+		t.Errorf("got %v at the front, want hot", e.Key)
+	}
+	if err := c.CheckInvariants(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWithTotalCapacity(t *testing.T) {
+	c := cache.New(cache.WithShards(16), cache.WithTotalCapacity(100))
+	for i := 0; i < 1000; i++ {
+		c.Add(i, i)
+		if l := c.Len(); l > 100 {
+			t.Fatalf("got len %d after adding %d, want at most 100", l, i)
+		}
+	}
+	if l := c.Len(); l != 100 {
+		t.Errorf("got len %d, want 100", l)
+	}
+	if v, ok := c.Get(999); !ok || v != 999 {
+		t.Errorf("got %v, %v for the last key; want 999, true", v, ok)
+	}
+	if err := c.CheckInvariants(); err != nil {
+		t.Error(err)
+	}
+
+	other := cache.New(cache.WithShards(4))
+	for i := 0; i < 200; i++ {
+		other.Add(i, i)
+	}
+	c.Swap(other) // the capacities are swapped too
+	other.Add(1000, 1000)
+	if c.Len() != 200 || other.Len() != 100 {
+		t.Errorf("got lens %d and %d after swap, want 200 and 100", c.Len(), other.Len())
+	}
+	if err := other.CheckInvariants(); err != nil {
+		t.Error(err)
+	}
+
+	// more shards than entries, so most shards are empty when they're added to
+	c = cache.New(cache.WithShards(16), cache.WithTotalCapacity(4))
+	for i := 0; i < 100; i++ {
+		c.Add(i, i)
+		if l := c.Len(); l > 4 {
+			t.Fatalf("got len %d after adding %d, want at most 4", l, i)
+		}
+	}
+
+	var wg sync.WaitGroup
+	c = cache.New(cache.WithShards(8), cache.WithTotalCapacity(50))
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				c.Add(g*1000+i, i)
+			}
+		}(g)
+	}
+	wg.Wait()
+	if l := c.Len(); l > 50 {
+		t.Errorf("got len %d after concurrent adds, want at most 50", l)
+	}
+	if err := c.CheckInvariants(); err != nil {
+		t.Error(err)
+	}
+
+	// Evict enforces the total capacity, not just that of each shard
+	c = cache.New(cache.WithShards(4), cache.WithTotalCapacity(10), cache.WithManualEviction())
+	for i := 0; i < 100; i++ {
+		c.Add(i, i)
+	}
+	if n := c.Evict(); n != 90 || c.Len() != 10 {
+		t.Errorf("got %d evicted and len %d, want 90 and 10", n, c.Len())
+	}
+	if err := c.CheckInvariants(); err != nil {
+		t.Error(err)
+	}
+}
+
 func ExampleNew() {
 	// create a new cache with a time-to-use of half a second
 	c := cache.New(cache.WithTTU(500 * time.Millisecond))
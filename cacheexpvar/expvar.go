@@ -0,0 +1,22 @@
+// Package cacheexpvar publishes the statistics of a cache.Cache through the
+// standard expvar package.
+//
+// It lives in its own package so that programs using the cache don't import
+// expvar, and thus register its HTTP handler, unless they ask for it.
+package cacheexpvar
+
+import (
+	"expvar"
+
+	"github.com/robteix/cache"
+)
+
+// Publish registers the statistics of c as an exported variable under the
+// given name. The statistics are read from the cache every time the variable
+// is read, so they are always current. As with expvar.Publish, it panics if
+// the name is already registered.
+func Publish(name string, c *cache.Cache) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return c.Stats()
+	}))
+}
@@ -0,0 +1,39 @@
+package cacheexpvar_test
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/robteix/cache"
+	"github.com/robteix/cache/cacheexpvar"
+)
+
+// runs numbers the runs of TestPublish, since names can't be published twice
+// and tests may run more than once, see go test -count
+var runs int32
+
+func TestPublish(t *testing.T) {
+	name := fmt.Sprint("test-cache-", atomic.AddInt32(&runs, 1))
+	c := cache.New()
+	cacheexpvar.Publish(name, c)
+
+	c.Add("hello", "world")
+	c.Get("hello")
+	c.Get("nope")
+
+	v := expvar.Get(name)
+	if v == nil {
+		t.Fatal("variable not published")
+	}
+
+	var st cache.Stats
+	if err := json.Unmarshal([]byte(v.String()), &st); err != nil {
+		t.Fatalf("could not decode %q: %v", v.String(), err)
+	}
+	if want := (cache.Stats{Hits: 1, Misses: 1, Entries: 1}); st != want {
+		t.Errorf("got %+v, want %+v", st, want)
+	}
+}
@@ -0,0 +1,112 @@
+package cache
+
+import "sync/atomic"
+
+// AddWithDeps is like Add, but also records that the entry depends on the
+// entries of the keys in dependsOn. When one of those is removed with Remove,
+// or made to expire with Expire, the entry is removed as well, and so on for
+// anything that depends on it. Cycles are allowed: each entry is removed at
+// most once.
+//
+// An entry that expires on its own takes its dependents with it when it's
+// purged, see Purge. One that is evicted doesn't. Adding a key again with
+// AddWithDeps replaces its dependencies; adding it with Add keeps them.
+func (c *Cache) AddWithDeps(key, val interface{}, dependsOn ...interface{}) {
+	c.init()
+	c.Add(key, val)
+
+	c.depMu.Lock()
+	defer c.depMu.Unlock()
+
+	if c.dependents == nil {
+		c.dependents = make(map[interface{}]map[interface{}]struct{})
+		c.dependencies = make(map[interface{}][]interface{})
+		atomic.StoreInt32(&c.hasDeps, 1)
+	}
+
+	c.forgetLocked(key)
+	if len(dependsOn) == 0 {
+		return
+	}
+	for _, base := range dependsOn {
+		deps, ok := c.dependents[base]
+		if !ok {
+			deps = make(map[interface{}]struct{})
+			c.dependents[base] = deps
+		}
+		deps[key] = struct{}{}
+	}
+	c.dependencies[key] = append([]interface{}(nil), dependsOn...)
+}
+
+// swapDeps exchanges the dependencies of c and other, see Swap
+func (c *Cache) swapDeps(other *Cache) {
+	c.depMu.Lock()
+	defer c.depMu.Unlock()
+	other.depMu.Lock()
+	defer other.depMu.Unlock()
+
+	c.dependents, other.dependents = other.dependents, c.dependents
+	c.dependencies, other.dependencies = other.dependencies, c.dependencies
+	if atomic.LoadInt32(&c.hasDeps) != 0 || atomic.LoadInt32(&other.hasDeps) != 0 {
+		atomic.StoreInt32(&c.hasDeps, 1)
+		atomic.StoreInt32(&other.hasDeps, 1)
+	}
+}
+
+// removeDependents removes, recursively, the entries that depend on key
+func (c *Cache) removeDependents(key interface{}) {
+	if atomic.LoadInt32(&c.hasDeps) == 0 {
+		return
+	}
+
+	seen := map[interface{}]struct{}{key: {}}
+	queue := c.dependentsOf(key)
+	for len(queue) > 0 {
+		k := queue[0]
+		queue = queue[1:]
+		if _, ok := seen[k]; ok {
+			continue
+		}
+		seen[k] = struct{}{}
+
+		// collect its dependents before removing it, since that forgets them
+		queue = append(queue, c.dependentsOf(k)...)
+		c.shard(k).remove(k)
+	}
+}
+
+// dependentsOf returns the keys that directly depend on key
+func (c *Cache) dependentsOf(key interface{}) []interface{} {
+	c.depMu.Lock()
+	defer c.depMu.Unlock()
+
+	var keys []interface{}
+	for k := range c.dependents[key] {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// forget drops the dependencies of a key that's no longer in the cache
+func (c *Cache) forget(key interface{}) {
+	if atomic.LoadInt32(&c.hasDeps) == 0 {
+		return
+	}
+	c.depMu.Lock()
+	c.forgetLocked(key)
+	c.depMu.Unlock()
+}
+
+// like forget, but the caller must hold depMu
+func (c *Cache) forgetLocked(key interface{}) {
+	for _, base := range c.dependencies[key] {
+		if deps := c.dependents[base]; deps != nil {
+			delete(deps, key)
+			if len(deps) == 0 {
+				delete(c.dependents, base)
+			}
+		}
+	}
+	delete(c.dependencies, key)
+}
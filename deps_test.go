@@ -0,0 +1,88 @@
+package cache_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/robteix/cache"
+)
+
+func TestCache_AddWithDeps(t *testing.T) {
+	c := cache.New(cache.WithShards(4))
+	c.Add("user", "alice")
+	c.AddWithDeps("profile", "alice's profile", "user")
+	c.AddWithDeps("avatar", "alice's avatar", "profile")
+	c.AddWithDeps("page", "alice's page", "profile", "avatar")
+	c.Add("unrelated", 1)
+
+	c.Remove("user")
+	for _, k := range []string{"user", "profile", "avatar", "page"} {
+		if _, ok := c.Get(k); ok {
+			t.Errorf("%s survived the removal of what it depends on", k)
+		}
+	}
+	if c.Len() != 1 {
+		t.Errorf("got len() %d, want 1", c.Len())
+	}
+}
+
+func TestCache_AddWithDepsCycle(t *testing.T) {
+	c := cache.New()
+	c.AddWithDeps("a", 1, "b")
+	c.AddWithDeps("b", 2, "c")
+	c.AddWithDeps("c", 3, "a")
+
+	c.Remove("b")
+	if c.Len() != 0 {
+		t.Errorf("got len() %d, want 0", c.Len())
+	}
+}
+
+func TestCache_AddWithDepsReplaced(t *testing.T) {
+	c := cache.New()
+	c.Add("a", 1)
+	c.Add("b", 2)
+	c.AddWithDeps("c", 3, "a")
+	c.AddWithDeps("c", 3, "b") // no longer depends on a
+
+	c.Remove("a")
+	if _, ok := c.Get("c"); !ok {
+		t.Error("c was removed along with a former dependency")
+	}
+	c.Remove("b")
+	if _, ok := c.Get("c"); ok {
+		t.Error("c survived the removal of its dependency")
+	}
+}
+
+func TestCache_AddWithDepsExpired(t *testing.T) {
+	c := cache.New(cache.WithShards(4), cache.WithTTU(time.Hour))
+	c.Add("user", "alice")
+	c.AddWithDeps("profile", "alice's profile", "user")
+	c.AddWithDeps("avatar", "alice's avatar", "profile")
+	c.Add("unrelated", 1)
+
+	c.Expire("user")
+	for _, k := range []string{"profile", "avatar"} {
+		if _, _, ok := c.GetStale(k); ok {
+			t.Errorf("%s survived the expiration of what it depends on", k)
+		}
+	}
+
+	// entries that expire on their own take their dependents when purged
+	c.Add("user", "bob")
+	c.AddWithDeps("profile", "bob's profile", "user")
+	c.AddWithDeps("avatar", "bob's avatar", "profile")
+	c.SetLastUsed("user", time.Now().Add(-2*time.Hour))
+	if n := c.Purge(); n != 1 { // the dependents are removed, not purged
+		t.Errorf("got %d purged, want 1", n)
+	}
+	for _, k := range []string{"user", "profile", "avatar"} {
+		if _, _, ok := c.GetStale(k); ok {
+			t.Errorf("%s survived the purge of what it depends on", k)
+		}
+	}
+	if c.Len() != 1 {
+		t.Errorf("got len() %d, want 1", c.Len())
+	}
+}
@@ -0,0 +1,64 @@
+package cache
+
+import "sync"
+
+// keyLock is the lock of a key, see LockEntry
+type keyLock struct {
+	sync.Mutex
+	refs int // goroutines holding or waiting for the lock, under the shard's mutex
+}
+
+// LockEntry locks key, waiting until no one else holds its lock, and returns its
+// value along with the function that releases the lock, which must be called
+// once the caller is done with the value. If key isn't in the cache, nothing is
+// locked and ok is false. This lets callers work on mutable values, such as
+// connection pools, one at a time per key, for as long as they need, without
+// blocking other keys of the same shard.
+//
+// The lock only coordinates callers of LockEntry: it doesn't keep anyone else
+// from reading, replacing or removing the entry, and the entry may still be
+// evicted or expire while it's locked. The caller keeps the value it got in
+// any case, and the lock belongs to the key rather than to the entry, so a
+// value added for the key in the meantime is covered by the same lock.
+//
+// As with any lock, callers that lock several keys must do it in a consistent
+// order to avoid deadlocks, and must not lock a key they already hold.
+func (c *Cache) LockEntry(key interface{}) (value interface{}, unlock func(), ok bool) {
+	c.init()
+	s := c.shard(key)
+
+	s.Lock()
+	if _, ok := s.peek(key); !ok {
+		s.Unlock()
+		return nil, nil, false
+	}
+	kl, found := s.locks[key]
+	if !found {
+		kl = &keyLock{}
+		s.locks[key] = kl
+	}
+	kl.refs++
+	s.Unlock()
+
+	kl.Lock()
+	release := func() {
+		kl.Unlock()
+		s.Lock()
+		if kl.refs--; kl.refs == 0 {
+			delete(s.locks, key)
+		}
+		s.Unlock()
+	}
+
+	// the entry may have gone while we waited for the lock
+	s.Lock()
+	value, ok = s.lookup(key)
+	s.Unlock()
+	if !ok {
+		release()
+		return nil, nil, false
+	}
+
+	var once sync.Once
+	return c.copy(value), func() { once.Do(release) }, true
+}
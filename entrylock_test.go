@@ -0,0 +1,59 @@
+package cache_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/robteix/cache"
+)
+
+func TestCache_LockEntry(t *testing.T) {
+	c := cache.New()
+	c.Add("pool", &[]int{})
+	c.Add("other", 1)
+
+	if _, _, ok := c.LockEntry("missing"); ok {
+		t.Error("locked a missing key")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			v, unlock, ok := c.LockEntry("pool")
+			if !ok {
+				t.Error("pool not found")
+				return
+			}
+			defer unlock()
+			pool := v.(*[]int)
+			*pool = append(*pool, i) // would race without the lock
+		}(i)
+	}
+	wg.Wait()
+	if v, _ := c.Get("pool"); len(*v.(*[]int)) != 20 {
+		t.Errorf("got %d items, want 20", len(*v.(*[]int)))
+	}
+
+	// other keys of the shard aren't blocked, and the entry can go
+	_, unlock, _ := c.LockEntry("pool")
+	done := make(chan struct{})
+	go func() {
+		_, unlockOther, _ := c.LockEntry("other")
+		unlockOther()
+		c.Remove("pool")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("blocked by the lock of another key")
+	}
+	unlock()
+	unlock() // no-op
+	if _, _, ok := c.LockEntry("pool"); ok {
+		t.Error("locked a removed key")
+	}
+}
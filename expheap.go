@@ -0,0 +1,96 @@
+package cache
+
+import (
+	"container/heap"
+	"time"
+)
+
+// expHeap implements heap.Interface to keep the entries of a shard that can
+// expire ordered by when they expire, so that purges find the expired entries
+// without going through the others, whatever their order in the LRU list.
+//
+// The time an entry is kept under, its expAt, is never later than when it
+// actually expires, but it may be earlier: reads push expiration back without
+// updating the heap, which would cost every read a heap operation. Purges fix
+// such entries as they come across them.
+type expHeap []*cacheEntry
+
+func (h expHeap) Len() int           { return len(h) }
+func (h expHeap) Less(i, j int) bool { return h[i].expAt.Before(h[j].expAt) }
+
+func (h expHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].expIdx = i
+	h[j].expIdx = j
+}
+
+func (h *expHeap) Push(x interface{}) {
+	ce := x.(*cacheEntry)
+	ce.expIdx = len(*h)
+	*h = append(*h, ce)
+}
+
+func (h *expHeap) Pop() interface{} {
+	old := *h
+	ce := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	ce.expIdx = -1
+	return ce
+}
+
+// schedules an entry to be purged when it expires, or unschedules it if it
+// never does. It must be called whenever the expiration of an entry may have
+// moved earlier; it may be skipped if it could only have moved later. Caller
+// must hold the mutex.
+func (s *shard) scheduleExpiry(ce *cacheEntry) {
+	t := s.expiresAt(ce)
+	switch {
+	case t.IsZero():
+		s.unscheduleExpiry(ce)
+	case ce.expIdx >= 0:
+		ce.expAt = t
+		heap.Fix(&s.exp, ce.expIdx)
+	default:
+		ce.expAt = t
+		heap.Push(&s.exp, ce)
+	}
+}
+
+// removes an entry from the expiration heap, if it's in it. Caller must hold
+// the mutex.
+func (s *shard) unscheduleExpiry(ce *cacheEntry) {
+	if ce.expIdx >= 0 {
+		heap.Remove(&s.exp, ce.expIdx)
+	}
+}
+
+// reschedules all entries of the expiration heap, after their expiration moved
+// earlier. Caller must hold the mutex.
+func (s *shard) rescheduleAll() {
+	for _, ce := range s.exp {
+		ce.expAt = s.expiresAt(ce)
+	}
+	heap.Init(&s.exp)
+}
+
+// removes the entries of the expiration heap that expired before now,
+// examining at most budget entries, and returns how many were removed and
+// examined. If budget is 0 or less, there is no limit. Caller must hold the
+// mutex.
+func (s *shard) purgeExpired(now time.Time, budget int) (expired, examined int) {
+	for len(s.exp) > 0 && (budget <= 0 || examined < budget) {
+		ce := s.exp[0]
+		if !ce.expAt.Before(now) {
+			break // no more expired entries
+		}
+		examined++
+		if s.expired(ce) {
+			s.removeElement(ce, ReasonExpired)
+			expired++
+		} else {
+			s.scheduleExpiry(ce) // it was used since it was scheduled
+		}
+	}
+	return expired, examined
+}
@@ -0,0 +1,59 @@
+package cache_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/robteix/cache"
+)
+
+func TestCache_PurgeOutOfOrder(t *testing.T) {
+	c := cache.New(cache.WithTTU(time.Hour))
+	// the entries expiring first are the most recently used ones
+	for i := 0; i < 10; i++ {
+		c.Add(i, i)
+	}
+	for i := 10; i < 20; i++ {
+		c.AddWithTTU(i, i, 20*time.Millisecond)
+	}
+	time.Sleep(30 * time.Millisecond)
+
+	if n := c.PurgeWithBudget(5); n != 5 {
+		t.Errorf("purged %d entries with a budget of 5, want 5", n)
+	}
+	if n := c.PurgeWithBudget(5); n != 5 {
+		t.Errorf("purged %d entries with a budget of 5, want 5", n)
+	}
+	if st := c.LastPurgeStats(); st.Scanned != 5 {
+		t.Errorf("scanned %d entries, want 5", st.Scanned)
+	}
+	for i := 0; i < 20; i++ {
+		if c.Contains(i) != (i < 10) {
+			t.Errorf("got %v for %d", c.Contains(i), i)
+		}
+	}
+	if err := c.CheckInvariants(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCache_PurgeRenewedEntries(t *testing.T) {
+	c := cache.New(cache.WithTTU(40 * time.Millisecond))
+	c.Add("used", 1)
+	c.Add("idle", 2)
+	time.Sleep(20 * time.Millisecond)
+	c.Get("used") // renews its TTU without updating the heap
+	time.Sleep(30 * time.Millisecond)
+
+	if n := c.Purge(); n != 1 || !c.Contains("used") {
+		t.Errorf("purged %d entries, want 1 and used kept", n)
+	}
+	if err := c.CheckInvariants(); err != nil {
+		t.Error(err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if n := c.Purge(); n != 1 || c.Len() != 0 {
+		t.Errorf("purged %d entries, %d left; want 1 and 0", n, c.Len())
+	}
+}
@@ -0,0 +1,15 @@
+package cache
+
+// CheckInvariants exposes checkInvariants to the tests of package cache_test
+func (c *Cache) CheckInvariants() error {
+	return c.checkInvariants()
+}
+
+// LockShard locks the shard with index i for the tests of package cache_test,
+// and returns the function that unlocks it
+func (c *Cache) LockShard(i int) (unlock func()) {
+	c.init()
+	s := c.shards[i]
+	s.Mutex.Lock()
+	return s.Mutex.Unlock
+}
@@ -1 +1,3 @@
 module github.com/robteix/cache
+
+go 1.18
@@ -0,0 +1,111 @@
+package cache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Handle controls the lifetime of a single entry of the cache, as returned by
+// AddManaged. Once the entry is removed from the cache, whether it's evicted,
+// expired, removed or replaced by Rename, the handle becomes inert: its methods
+// have no effect, even if the key is added again.
+type Handle struct {
+	c   *Cache
+	key interface{}
+	ce  *cacheEntry
+}
+
+// AddManaged is like Add, but the entry has its own TTU, which takes precedence
+// over the cache's, and the returned Handle gives control over its lifetime
+// without having to look it up again. Like the cache's TTU, the entry's is
+// renewed every time it's read. The ttu must be larger than 0. If the cache is
+// disabled, see WithDisabled, the returned handle is inert.
+func (c *Cache) AddManaged(key, val interface{}, ttu time.Duration) Handle {
+	if ttu <= 0 {
+		panic("the TTU must be larger than 0")
+	}
+	c.init()
+	c.noteEntryTTU(ttu)
+
+	s := c.shard(key)
+	s.Lock()
+	defer s.Unlock()
+
+	s.set(key, val)
+	ce, found := s.idx[key]
+	if !found {
+		return Handle{} // the cache is disabled
+	}
+	ce.ttu = ttu
+	s.scheduleExpiry(ce)
+	return Handle{c: c, key: key, ce: ce}
+}
+
+// AddWithTTU is like Add, but the entry has its own TTU, which takes precedence
+// over the cache's, if any. It's AddManaged for callers that don't need the
+// handle. Adding the key again with Add keeps the entry's TTU, while
+// AddWithTTU replaces it. The ttu must be larger than 0.
+func (c *Cache) AddWithTTU(key, val interface{}, ttu time.Duration) {
+	c.AddManaged(key, val, ttu)
+}
+
+// noteEntryTTU records that an entry has its own TTU
+func (c *Cache) noteEntryTTU(ttu time.Duration) {
+	for {
+		max := atomic.LoadInt64(&c.maxEntryTTU)
+		if int64(ttu) <= max || atomic.CompareAndSwapInt64(&c.maxEntryTTU, max, int64(ttu)) {
+			return
+		}
+	}
+}
+
+// do calls fn with the handle's entry while holding its shard's lock, and
+// returns whether the entry is still in the cache and hasn't expired
+func (h Handle) do(fn func(s *shard, ce *cacheEntry)) bool {
+	if h.c == nil {
+		return false
+	}
+	s := h.c.shard(h.key)
+	s.Lock()
+	defer s.Unlock()
+
+	ce, found := s.idx[h.key]
+	if !found || ce != h.ce || s.expired(h.ce) {
+		return false
+	}
+	if fn != nil {
+		fn(s, ce)
+	}
+	return true
+}
+
+// Extend lengthens the TTU of the entry by d, and returns whether the entry
+// was still in the cache. It doesn't count as a use of the entry.
+func (h Handle) Extend(d time.Duration) bool {
+	return h.do(func(s *shard, ce *cacheEntry) {
+		h.ce.ttu += d
+		h.c.noteEntryTTU(h.ce.ttu)
+	})
+}
+
+// Expire makes the entry expire immediately, and returns whether it was still
+// in the cache. Like the entries marked by Invalidate, it's still served by
+// GetStale until it's purged. Entries that depend on it, see AddWithDeps, are
+// removed, as with Cache.Expire.
+func (h Handle) Expire() bool {
+	if !h.do(func(s *shard, ce *cacheEntry) { s.expireEntry(ce) }) {
+		return false
+	}
+	h.c.removeDependents(h.key)
+	return true
+}
+
+// Remaining returns how long the entry has left until it expires, unless it's
+// used again, or 0 if it's no longer in the cache.
+func (h Handle) Remaining() time.Duration {
+	var d time.Duration
+	h.do(func(s *shard, ce *cacheEntry) {
+		d = time.Until(s.expiresAt(h.ce))
+	})
+	return d
+}
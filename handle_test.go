@@ -0,0 +1,94 @@
+package cache_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/robteix/cache"
+)
+
+func TestCache_AddManaged(t *testing.T) {
+	c := cache.New(cache.WithTTU(time.Hour))
+	short := c.AddManaged("short", 1, 20*time.Millisecond)
+	long := c.AddManaged("long", 2, time.Hour)
+	c.Add("default", 3)
+
+	if r := short.Remaining(); r <= 0 || r > 20*time.Millisecond {
+		t.Errorf("got %v remaining, want up to 20ms", r)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := c.Get("short"); ok {
+		t.Error("entry outlived its own TTU")
+	}
+	if short.Remaining() != 0 || short.Extend(time.Hour) {
+		t.Error("handle of an expired entry isn't inert")
+	}
+	if n := c.Purge(); n != 1 {
+		t.Errorf("purged %d entries, want 1", n)
+	}
+
+	if !long.Expire() {
+		t.Error("couldn't expire a live entry")
+	}
+	if _, ok := c.Get("long"); ok {
+		t.Error("got an expired entry")
+	}
+	if _, ok := c.Get("default"); !ok {
+		t.Error("an entry with the cache's TTU expired")
+	}
+}
+
+func TestCache_AddWithTTU(t *testing.T) {
+	c := cache.New() // no TTU of its own
+	for i := 0; i < 4; i++ {
+		c.AddWithTTU(fmt.Sprint("token", i), i, 20*time.Millisecond)
+		c.AddWithTTU(fmt.Sprint("config", i), i, time.Hour)
+	}
+	c.Add("forever", 0)
+	c.Add("token0", 42) // keeps its TTU
+
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := c.Get("token0"); ok {
+		t.Error("got an entry past its own TTU")
+	}
+	if n := c.Purge(); n != 4 {
+		t.Errorf("purged %d entries, want 4", n)
+	}
+	if c.Len() != 5 {
+		t.Errorf("got len %d, want 5", c.Len())
+	}
+	for i := 0; i < 4; i++ {
+		if _, ok := c.Get(fmt.Sprint("config", i)); !ok {
+			t.Errorf("config%d expired", i)
+		}
+	}
+	if _, ok := c.Get("forever"); !ok {
+		t.Error("an entry without TTU expired")
+	}
+}
+
+func TestHandle_Extend(t *testing.T) {
+	c := cache.New()
+	h := c.AddManaged("key", 1, 20*time.Millisecond)
+	if !h.Extend(time.Hour) {
+		t.Fatal("couldn't extend a live entry")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := c.Get("key"); !ok {
+		t.Error("extended entry expired")
+	}
+	if r := h.Remaining(); r < 59*time.Minute {
+		t.Errorf("got %v remaining, want about 1h", r)
+	}
+
+	// the handle doesn't follow the key once its entry is gone
+	c.Remove("key")
+	c.Add("key", 2)
+	if h.Expire() {
+		t.Error("handle expired an entry it doesn't manage")
+	}
+	if _, ok := c.Get("key"); !ok {
+		t.Error("entry added after the handle's was removed is gone")
+	}
+}
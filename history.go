@@ -0,0 +1,111 @@
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+// EvictReason tells why an entry was removed from the cache
+type EvictReason int
+
+const (
+	// ReasonCapacity means the entry was evicted to make room for others
+	ReasonCapacity EvictReason = iota
+	// ReasonExpired means the entry expired and was purged
+	ReasonExpired
+	// ReasonRemoved means the entry was explicitly removed, or rejected by
+	// the read validator
+	ReasonRemoved
+	// ReasonReplaced means the value of the entry was replaced by adding its
+	// key again, see WithOnEvict
+	ReasonReplaced
+	// ReasonCleared means the entry was removed by Clear
+	ReasonCleared
+)
+
+func (r EvictReason) String() string {
+	switch r {
+	case ReasonCapacity:
+		return "capacity"
+	case ReasonExpired:
+		return "expired"
+	case ReasonRemoved:
+		return "removed"
+	case ReasonReplaced:
+		return "replaced"
+	case ReasonCleared:
+		return "cleared"
+	}
+	return "unknown"
+}
+
+// EvictEvent records the removal of an entry from the cache
+type EvictEvent struct {
+	Key    interface{}
+	Reason EvictReason
+	Time   time.Time
+}
+
+// history is a fixed-size ring of the most recent evictions
+type history struct {
+	mu     sync.Mutex
+	events []EvictEvent
+	next   int  // where the next event goes
+	full   bool // whether the ring has wrapped around
+}
+
+func newHistory(size int) *history {
+	return &history{events: make([]EvictEvent, size)}
+}
+
+// record adds an event to the ring, overwriting the oldest one if it's full.
+// A nil history records nothing.
+func (h *history) record(key interface{}, reason EvictReason) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.events[h.next] = EvictEvent{Key: key, Reason: reason, Time: time.Now()}
+	h.next++
+	if h.next == len(h.events) {
+		h.next, h.full = 0, true
+	}
+}
+
+// recent returns the recorded events, from the oldest to the most recent
+func (h *history) recent() []EvictEvent {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var evs []EvictEvent
+	if h.full {
+		evs = append(evs, h.events[h.next:]...)
+	}
+	return append(evs, h.events[:h.next]...)
+}
+
+// RecentEvictions returns the most recent removals of entries from the cache,
+// from the oldest to the most recent, as recorded when the cache is created
+// with WithEvictionHistory. Only the last few removals are remembered, and a
+// key may appear several times if it was added and removed repeatedly.
+func (c *Cache) RecentEvictions() []EvictEvent {
+	c.init()
+	return c.history.recent()
+}
+
+// WasRecentlyEvicted returns the most recent removal of key from the cache, if
+// it's still remembered by the eviction history. See RecentEvictions.
+func (c *Cache) WasRecentlyEvicted(key interface{}) (EvictEvent, bool) {
+	evs := c.RecentEvictions()
+	for i := len(evs) - 1; i >= 0; i-- {
+		if evs[i].Key == key {
+			return evs[i], true
+		}
+	}
+	return EvictEvent{}, false
+}
@@ -0,0 +1,77 @@
+package cache
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// checkInvariants verifies the internal consistency of the cache, returning an
+// error describing the first violation found. It's meant for tests.
+func (c *Cache) checkInvariants() error {
+	c.init()
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	n := 0
+	for i, s := range c.shards {
+		if err := s.checkInvariants(); err != nil {
+			return fmt.Errorf("shard %d: %v", i, err)
+		}
+		n += s.len()
+	}
+	if c.totalCap > 0 {
+		if entries := atomic.LoadInt64(&c.entries); entries != int64(n) {
+			return fmt.Errorf("%d entries counted, want %d", entries, n)
+		}
+	}
+	return nil
+}
+
+func (s *shard) checkInvariants() error {
+	s.Lock()
+	defer s.Unlock()
+
+	n, bytes := 0, int64(0)
+	for _, l := range []*entryList{s.l, s.prot} {
+		var prev *cacheEntry
+		for ce := l.Front(); ce != nil; ce = ce.Next() {
+			n++
+			bytes += ce.size
+			if s.idx[ce.key] != ce {
+				return fmt.Errorf("entry %v isn't indexed", ce.key)
+			}
+			if s.list(ce) != l {
+				return fmt.Errorf("entry %v is in the wrong segment (protected: %v)", ce.key, ce.protected)
+			}
+			if prev != nil && prev.lu.Before(ce.lu) {
+				return fmt.Errorf("entry %v was used after %v but is behind it", ce.key, prev.key)
+			}
+			if s.c.shard(ce.key) != s {
+				return fmt.Errorf("entry %v is in the wrong shard", ce.key)
+			}
+			if t := s.expiresAt(ce); t.IsZero() != (ce.expIdx < 0) {
+				return fmt.Errorf("entry %v expiring at %v has heap index %d", ce.key, t, ce.expIdx)
+			} else if ce.expIdx >= 0 && (ce.expIdx >= len(s.exp) || s.exp[ce.expIdx] != ce || ce.expAt.After(t)) {
+				return fmt.Errorf("entry %v isn't scheduled to expire by %v", ce.key, t)
+			}
+			prev = ce
+		}
+	}
+	if n != len(s.idx) {
+		return fmt.Errorf("%d entries in the lists but %d in the index", n, len(s.idx))
+	}
+	if s.c.cap > 0 && !s.c.manualEviction && n > s.c.cap {
+		return fmt.Errorf("%d entries over a capacity of %d", n, s.c.cap)
+	}
+	if len(s.exp) > n {
+		return fmt.Errorf("%d entries in the expiration heap but %d in the lists", len(s.exp), n)
+	}
+	if bytes != s.bytes {
+		return fmt.Errorf("%d bytes counted, want %d", s.bytes, bytes)
+	}
+	if max := s.protectedCap(); max >= 0 && s.prot.Len() > max {
+		return fmt.Errorf("%d protected entries over a limit of %d", s.prot.Len(), max)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// jsonEntry is the JSON representation of an entry, see DumpJSON
+type jsonEntry struct {
+	Key       json.RawMessage `json:"key"`
+	Value     json.RawMessage `json:"value"`
+	LastUsed  time.Time       `json:"last_used"`
+	Remaining string          `json:"remaining,omitempty"`
+}
+
+// DumpJSON writes the live entries of the cache to w as a JSON array of
+// objects holding their key, value, last used time and, for entries that
+// expire, the time remaining until they do. This is meant for debugging, for
+// instance from an HTTP handler. Keys and values that can't be marshaled to
+// JSON are written as strings, formatted with fmt.
+//
+// At most maxEntries entries are written, so that dumping a large cache
+// doesn't produce a huge response; if maxEntries is 0 or less, there is no
+// limit. Entries are written shard by shard, most recently used first, and
+// each shard is only locked while its entries are collected.
+func (c *Cache) DumpJSON(w io.Writer, maxEntries int) error {
+	c.init()
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString("[")
+	n := 0
+	for _, s := range c.allShards() {
+		if maxEntries > 0 && n >= maxEntries {
+			break
+		}
+		limit := 0
+		if maxEntries > 0 {
+			limit = maxEntries - n
+		}
+		for _, e := range s.dump(limit) {
+			if n > 0 {
+				bw.WriteString(",")
+			}
+			b, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			bw.Write(b)
+			n++
+		}
+	}
+	bw.WriteString("]\n")
+	return bw.Flush()
+}
+
+// returns up to limit live entries of the shard, or all of them if limit is 0
+// or less
+func (s *shard) dump(limit int) []jsonEntry {
+	type entry struct {
+		key, val  interface{}
+		lu        time.Time
+		remaining time.Duration
+	}
+
+	s.Lock()
+	var entries []entry
+	now := time.Now()
+	for _, l := range []*entryList{s.prot, s.l} {
+		for ce := l.Front(); ce != nil && (limit <= 0 || len(entries) < limit); ce = ce.Next() {
+			if s.expired(ce) {
+				continue
+			}
+			e := entry{key: ce.key, val: ce.val, lu: ce.lu}
+			if t := s.expiresAt(ce); !t.IsZero() {
+				e.remaining = t.Sub(now)
+			}
+			entries = append(entries, e)
+		}
+	}
+	s.Unlock()
+
+	// marshal outside of the lock, as it may be slow
+	res := make([]jsonEntry, len(entries))
+	for i, e := range entries {
+		res[i] = jsonEntry{Key: marshalOrString(e.key), Value: marshalOrString(e.val), LastUsed: e.lu}
+		if e.remaining != 0 {
+			res[i].Remaining = e.remaining.Round(time.Millisecond).String()
+		}
+	}
+	return res
+}
+
+// marshalOrString returns the JSON encoding of v, or of its string
+// representation if it can't be marshaled
+func marshalOrString(v interface{}) json.RawMessage {
+	if b, err := json.Marshal(v); err == nil {
+		return b
+	}
+	b, _ := json.Marshal(fmt.Sprint(v))
+	return b
+}
@@ -0,0 +1,59 @@
+package cache_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/robteix/cache"
+)
+
+func TestCache_DumpJSON(t *testing.T) {
+	c := cache.New(cache.WithTTU(time.Hour))
+	c.Add("a", 1)
+	c.Add("b", []string{"x", "y"})
+	c.Add("c", func() {}) // can't be marshaled
+	c.Add("expired", 4)
+	c.SetLastUsed("expired", time.Now().Add(-2*time.Hour))
+
+	var buf bytes.Buffer
+	if err := c.DumpJSON(&buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	var entries []struct {
+		Key       string
+		Value     interface{}
+		LastUsed  time.Time `json:"last_used"`
+		Remaining string
+	}
+	if err := json.Unmarshal(buf.Bytes(), &entries); err != nil {
+		t.Fatalf("%v in %s", err, buf.Bytes())
+	}
+	if len(entries) != 3 {
+		t.Fatalf("got %d entries, want 3: %s", len(entries), buf.Bytes())
+	}
+	for _, e := range entries {
+		if e.LastUsed.IsZero() || e.Remaining == "" {
+			t.Errorf("missing metadata in %+v", e)
+		}
+		switch e.Key {
+		case "a":
+			if e.Value != 1.0 {
+				t.Errorf("got value %v for a, want 1", e.Value)
+			}
+		case "c":
+			if _, ok := e.Value.(string); !ok {
+				t.Errorf("got value %v for c, want a string", e.Value)
+			}
+		}
+	}
+
+	buf.Reset()
+	if err := c.DumpJSON(&buf, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(buf.Bytes(), &entries); err != nil || len(entries) != 2 {
+		t.Errorf("got %d entries, %v; want 2, nil", len(entries), err)
+	}
+}
@@ -0,0 +1,133 @@
+package cache
+
+// entryList is a doubly linked list of cache entries. Unlike container/list,
+// the links are held by the entries themselves, which saves allocating an
+// element for every entry and type asserting its value on every access. An
+// entry can therefore be in a single list at a time.
+//
+// The zero value is an empty list ready to use.
+type entryList struct {
+	root cacheEntry // sentinel: root.next is the front and root.prev the back
+	len  int
+}
+
+// Init initializes or clears the list
+func (l *entryList) Init() *entryList {
+	l.root.next = &l.root
+	l.root.prev = &l.root
+	l.len = 0
+	return l
+}
+
+// lazyInit initializes a zero list
+func (l *entryList) lazyInit() {
+	if l.root.next == nil {
+		l.Init()
+	}
+}
+
+// Len returns the number of entries in the list
+func (l *entryList) Len() int { return l.len }
+
+// Front returns the first entry of the list, or nil if it's empty
+func (l *entryList) Front() *cacheEntry {
+	if l.len == 0 {
+		return nil
+	}
+	return l.root.next
+}
+
+// Back returns the last entry of the list, or nil if it's empty
+func (l *entryList) Back() *cacheEntry {
+	if l.len == 0 {
+		return nil
+	}
+	return l.root.prev
+}
+
+// insert inserts ce after at and returns ce
+func (l *entryList) insert(ce, at *cacheEntry) *cacheEntry {
+	ce.prev = at
+	ce.next = at.next
+	ce.prev.next = ce
+	ce.next.prev = ce
+	ce.list = l
+	l.len++
+	return ce
+}
+
+// PushFront inserts ce at the front of the list and returns it
+func (l *entryList) PushFront(ce *cacheEntry) *cacheEntry {
+	l.lazyInit()
+	return l.insert(ce, &l.root)
+}
+
+// Remove removes ce from the list, if it's in it, and returns it
+func (l *entryList) Remove(ce *cacheEntry) *cacheEntry {
+	if ce.list == l {
+		ce.prev.next = ce.next
+		ce.next.prev = ce.prev
+		ce.next, ce.prev, ce.list = nil, nil, nil
+		l.len--
+	}
+	return ce
+}
+
+// move moves ce to after at
+func (l *entryList) move(ce, at *cacheEntry) {
+	if ce == at {
+		return
+	}
+	ce.prev.next = ce.next
+	ce.next.prev = ce.prev
+
+	ce.prev = at
+	ce.next = at.next
+	ce.prev.next = ce
+	ce.next.prev = ce
+}
+
+// MoveToFront moves ce to the front of the list, if it's in it
+func (l *entryList) MoveToFront(ce *cacheEntry) {
+	if ce.list != l || l.root.next == ce {
+		return
+	}
+	l.move(ce, &l.root)
+}
+
+// MoveBefore moves ce to before mark, if both are in the list
+func (l *entryList) MoveBefore(ce, mark *cacheEntry) {
+	if ce.list != l || mark.list != l || ce == mark {
+		return
+	}
+	l.move(ce, mark.prev)
+}
+
+// MoveAfter moves ce to after mark, if both are in the list
+func (l *entryList) MoveAfter(ce, mark *cacheEntry) {
+	if ce.list != l || mark.list != l || ce == mark {
+		return
+	}
+	l.move(ce, mark)
+}
+
+// Next returns the entry after ce in its list, or nil if it's the last one
+func (ce *cacheEntry) Next() *cacheEntry {
+	if n := ce.next; ce.list != nil && n != &ce.list.root {
+		return n
+	}
+	return nil
+}
+
+// Prev returns the entry before ce in its list, or nil if it's the first one
+func (ce *cacheEntry) Prev() *cacheEntry {
+	if p := ce.prev; ce.list != nil && p != &ce.list.root {
+		return p
+	}
+	return nil
+}
+
+// newEntryList returns an empty list
+func newEntryList() *entryList {
+	return new(entryList).Init()
+}
@@ -0,0 +1,332 @@
+package cache
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrTooManyInFlight is returned by GetOrCompute and GetOrComputeMulti instead
+// of calling the loader when the max number of loads are already in flight.
+// See WithMaxInFlight.
+var ErrTooManyInFlight = errors.New("cache: too many loads in flight")
+
+// ErrLoaderPanicked is returned to the callers waiting for a load whose loader
+// panicked. The caller that called the loader gets the panic instead.
+var ErrLoaderPanicked = errors.New("cache: loader panicked")
+
+// call is a load of a key that is in flight or has completed
+type call struct {
+	done chan struct{} // closed when the load completes
+	val  interface{}   // the loaded value, if ok
+	ok   bool          // whether the load produced a value for the key
+	err  error         // the error returned by the loader
+}
+
+// GetOrCompute returns the value of key, calling loader to compute it if it
+// isn't in the cache. The computed value is added to the cache, unless the
+// loader returns an error, in which case nothing is cached and the error is
+// returned.
+//
+// Concurrent calls for the same missing key are deduplicated: the loader is
+// called by only one of them, and the others wait for it and share its result.
+// Since waiting callers are blocked until the loader returns, the loader must
+// not itself compute the same key through the cache.
+//
+// If the loader panics, the panic is propagated to the caller that called it,
+// and the callers waiting for it get ErrLoaderPanicked.
+//
+// If the cache has a circuit breaker, see WithLoaderCircuitBreaker, the loader
+// isn't called while it's open, and ErrBreakerOpen is returned instead.
+func (c *Cache) GetOrCompute(key interface{}, loader func(key interface{}) (interface{}, error)) (interface{}, error) {
+	c.init()
+
+	for {
+		if val, ok := c.Get(key); ok {
+			return val, nil
+		}
+
+		s := c.shard(key)
+		s.Lock()
+		if val, ok := s.lookup(key); ok {
+			// someone added it since we looked
+			s.Unlock()
+			return c.copy(val), nil
+		}
+		if cl, found := s.calls[key]; found {
+			s.Unlock()
+			<-cl.done
+			if cl.err != nil {
+				return cl.val, cl.err
+			}
+			if cl.ok {
+				return c.copy(cl.val), nil
+			}
+			// it was part of a batch that didn't produce it, so try again
+			continue
+		}
+		if !c.claimLoad() {
+			s.Unlock()
+			return nil, ErrTooManyInFlight
+		}
+		cl := &call{done: make(chan struct{})}
+		s.calls[key] = cl
+		s.Unlock()
+
+		c.callLoader(func() (err error) {
+			cl.val, err = loader(key)
+			return err
+		}, func(err error) {
+			cl.err = err
+			cl.ok = err == nil
+			s.finish(key, cl)
+		})
+		if cl.err != nil {
+			return cl.val, cl.err
+		}
+		return c.copy(cl.val), nil
+	}
+}
+
+// GetOrAdd is like GetOrCompute, for functions that don't need the key, such
+// as closures that already know what to fetch. Concurrent calls for the same
+// missing key call fn only once, and errors aren't cached.
+func (c *Cache) GetOrAdd(key interface{}, fn func() (interface{}, error)) (interface{}, error) {
+	return c.GetOrCompute(key, func(interface{}) (interface{}, error) {
+		return fn()
+	})
+}
+
+// GetOrReserve returns the value of key if it's in the cache. Otherwise, it
+// reserves key for the caller, who is then expected to produce the value and
+// pass it to commit, which adds it to the cache. This is a lower-level
+// alternative to GetOrCompute for values that aren't produced by a simple
+// function call, such as values delivered by another goroutine.
+//
+// Among concurrent callers for the same missing key, only one gets the
+// reservation. The others block until the value is committed, and then return
+// it as if it had been in the cache. They also wait for loads started by
+// GetOrCompute, and GetOrCompute waits for reservations, so a reservation must
+// always be committed, or they block forever. A producer that fails commits
+// its error instead of a value: nothing is cached, callers waiting in
+// GetOrCompute get the error, as they would from a failed loader, and callers
+// waiting in GetOrReserve try again, one of them getting a new reservation.
+// Calls to commit after the first one are ignored.
+//
+// If the cache is at its limit of loads in flight, see WithMaxInFlight, the key
+// is neither found nor reserved, and the caller may produce the value without
+// caching it.
+func (c *Cache) GetOrReserve(key interface{}) (value interface{}, reserved bool, commit func(value interface{}, err error), ok bool) {
+	c.init()
+
+	for {
+		if val, ok := c.Get(key); ok {
+			return val, false, nil, true
+		}
+
+		s := c.shard(key)
+		s.Lock()
+		if val, ok := s.lookup(key); ok {
+			s.Unlock()
+			return c.copy(val), false, nil, true
+		}
+		if cl, found := s.calls[key]; found {
+			s.Unlock()
+			<-cl.done
+			if cl.ok {
+				return c.copy(cl.val), false, nil, true
+			}
+			continue // the load failed or didn't produce it, so try again
+		}
+		if !c.claimLoad() {
+			s.Unlock()
+			return nil, false, nil, false
+		}
+		cl := &call{done: make(chan struct{})}
+		s.calls[key] = cl
+		s.Unlock()
+
+		var once sync.Once
+		return nil, true, func(value interface{}, err error) {
+			once.Do(func() {
+				cl.val, cl.err, cl.ok = value, err, err == nil
+				s.finish(key, cl)
+			})
+		}, false
+	}
+}
+
+// GetWithRefresh is like GetStale, but when the entry is stale it also calls
+// refresh, in a new goroutine, so that the caller can reload the entry while
+// the stale value is being served. Stale reads of a key that is already being
+// refreshed don't call refresh again until the running call returns, so a
+// burst of reads only triggers one refresh.
+func (c *Cache) GetWithRefresh(key interface{}, refresh func(key interface{})) (value interface{}, stale, ok bool) {
+	value, stale, ok = c.GetStale(key)
+	if !stale {
+		return value, stale, ok
+	}
+
+	s := c.shard(key)
+	s.Lock()
+	defer s.Unlock()
+	if _, found := s.busy[key]; !found {
+		s.busy[key] = struct{}{}
+		go func() {
+			defer func() {
+				s.Lock()
+				delete(s.busy, key)
+				s.Unlock()
+			}()
+			refresh(key)
+		}()
+	}
+	return value, stale, ok
+}
+
+// GetOrComputeMulti returns the values of keys, calling loader once with all
+// the keys that are missing from the cache. The loader returns the values it
+// found, by key, which are then added to the cache. Keys for which the loader
+// doesn't return a value are missing from the result.
+//
+// Like with GetOrCompute, keys that are already being loaded by another call
+// are not loaded again; the result of the other load is used instead. If a
+// loader fails, its error is returned along with the values that were
+// retrieved, and nothing it was loading is cached.
+func (c *Cache) GetOrComputeMulti(keys []interface{}, loader func(missing []interface{}) (map[interface{}]interface{}, error)) (map[interface{}]interface{}, error) {
+	c.init()
+
+	res := make(map[interface{}]interface{}, len(keys))
+	var missing []interface{}
+	for _, key := range keys {
+		if _, found := res[key]; found {
+			continue
+		}
+		if val, ok := c.Get(key); ok {
+			res[key] = val
+		} else {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) == 0 {
+		return res, nil
+	}
+
+	// claim the keys nobody is loading yet, and take note of the others
+	var err error
+	var own []interface{}
+	ours := make(map[interface{}]*call)
+	theirs := make(map[interface{}]*call)
+	for _, key := range missing {
+		if _, found := ours[key]; found {
+			continue
+		}
+		s := c.shard(key)
+		s.Lock()
+		if val, ok := s.lookup(key); ok {
+			res[key] = val
+		} else if cl, found := s.calls[key]; found {
+			theirs[key] = cl
+		} else if !c.claimLoad() {
+			err = ErrTooManyInFlight
+		} else {
+			cl := &call{done: make(chan struct{})}
+			s.calls[key] = cl
+			ours[key] = cl
+			own = append(own, key)
+		}
+		s.Unlock()
+	}
+
+	// we must finish our own loads before waiting for anyone else's, as
+	// they may be waiting for ours
+	if len(own) > 0 {
+		var vals map[interface{}]interface{}
+		c.callLoader(func() (err error) {
+			vals, err = loader(own)
+			return err
+		}, func(lerr error) {
+			if lerr != nil {
+				err = lerr
+			}
+			for _, key := range own {
+				cl := ours[key]
+				if lerr != nil {
+					cl.err = lerr
+				} else {
+					cl.val, cl.ok = vals[key]
+				}
+				if cl.ok {
+					res[key] = cl.val
+				}
+				c.shard(key).finish(key, cl)
+			}
+		})
+	}
+
+	for key, cl := range theirs {
+		<-cl.done
+		if cl.err != nil && err == nil {
+			err = cl.err
+		} else if cl.ok {
+			res[key] = cl.val
+		}
+	}
+
+	return res, err
+}
+
+// callLoader calls fn, which calls a loader, through the circuit breaker and
+// then calls done with the error of the load. If the breaker is open, fn isn't
+// called and done gets ErrBreakerOpen. If fn panics, done gets
+// ErrLoaderPanicked before the panic is propagated, so that the load is always
+// completed and nobody is left waiting for it.
+func (c *Cache) callLoader(fn func() error, done func(err error)) {
+	if err := c.breaker.allow(); err != nil {
+		done(err)
+		return
+	}
+
+	returned := false
+	defer func() {
+		if !returned {
+			c.breaker.done(ErrLoaderPanicked)
+			done(ErrLoaderPanicked)
+		}
+	}()
+	err := fn()
+	returned = true
+	c.breaker.done(err)
+	done(err)
+}
+
+// claimLoad counts a new load in flight, unless there are already as many as
+// allowed, in which case it returns false. Loads are uncounted by finish.
+func (c *Cache) claimLoad() bool {
+	n := atomic.AddInt64(&c.inFlight, 1)
+	if c.maxInFlight > 0 && n > int64(c.maxInFlight) {
+		atomic.AddInt64(&c.inFlight, -1)
+		return false
+	}
+	return true
+}
+
+// InFlightCount returns the number of loads started by GetOrCompute and
+// GetOrComputeMulti that haven't completed yet.
+func (c *Cache) InFlightCount() int {
+	return int(atomic.LoadInt64(&c.inFlight))
+}
+
+// finish completes a load, caching its value if it produced one, and wakes up
+// anyone waiting for it
+func (s *shard) finish(key interface{}, cl *call) {
+	defer close(cl.done)
+
+	s.Lock()
+	if cl.ok {
+		s.set(key, cl.val)
+	}
+	delete(s.calls, key)
+	atomic.AddInt64(&s.c.inFlight, -1)
+	s.Unlock()
+}
@@ -0,0 +1,460 @@
+package cache_test
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/robteix/cache"
+)
+
+func TestCache_GetOrCompute(t *testing.T) {
+	c := cache.New()
+
+	var calls int32
+	loader := func(key interface{}) (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(10 * time.Millisecond) // give everyone a chance to pile up
+		return key.(int) * 2, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, err := c.GetOrCompute(21, loader); err != nil || v != 42 {
+				t.Errorf("got %v, %v; want 42, nil", v, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("loader called %d times, want 1", calls)
+	}
+	if v, ok := c.Get(21); !ok || v != 42 {
+		t.Errorf("computed value not cached: got %v, %v", v, ok)
+	}
+}
+
+func TestCache_GetOrComputeError(t *testing.T) {
+	c := cache.New()
+	errBoom := errors.New("boom")
+
+	_, err := c.GetOrCompute("key", func(interface{}) (interface{}, error) {
+		return nil, errBoom
+	})
+	if err != errBoom {
+		t.Errorf("got error %v, want %v", err, errBoom)
+	}
+	if c.Len() != 0 {
+		t.Errorf("got len() %d, want 0", c.Len())
+	}
+}
+
+func TestCache_GetOrAdd(t *testing.T) {
+	c := cache.New()
+
+	var calls int32
+	fetch := func() (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(10 * time.Millisecond) // give everyone a chance to pile up
+		return "row", nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, err := c.GetOrAdd("id", fetch); err != nil || v != "row" {
+				t.Errorf("got %v, %v; want row, nil", v, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("fn called %d times, want 1", calls)
+	}
+
+	errBoom := errors.New("boom")
+	if _, err := c.GetOrAdd("other", func() (interface{}, error) { return nil, errBoom }); err != errBoom {
+		t.Errorf("got error %v, want %v", err, errBoom)
+	}
+	if c.Contains("other") {
+		t.Error("failed fetch was cached")
+	}
+}
+
+func TestCache_GetOrComputeMulti(t *testing.T) {
+	c := cache.New(cache.WithShards(4))
+	c.Add(1, 1)
+	c.Add(2, 2)
+
+	var got [][]interface{}
+	res, err := c.GetOrComputeMulti([]interface{}{1, 2, 3, 4, 5}, func(missing []interface{}) (map[interface{}]interface{}, error) {
+		got = append(got, missing)
+		vals := make(map[interface{}]interface{})
+		for _, k := range missing {
+			if k != 5 { // 5 doesn't exist in the backend
+				vals[k] = k
+			}
+		}
+		return vals, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 1 {
+		t.Fatalf("loader called %d times, want 1", len(got))
+	}
+	sort.Slice(got[0], func(i, j int) bool { return got[0][i].(int) < got[0][j].(int) })
+	if want := []interface{}{3, 4, 5}; !reflect.DeepEqual(got[0], want) {
+		t.Errorf("loader called with %v, want %v", got[0], want)
+	}
+	if want := map[interface{}]interface{}{1: 1, 2: 2, 3: 3, 4: 4}; !reflect.DeepEqual(res, want) {
+		t.Errorf("got %v, want %v", res, want)
+	}
+	if c.Len() != 4 {
+		t.Errorf("got len() %d, want 4", c.Len())
+	}
+}
+
+func TestCache_GetOrComputeMultiConcurrent(t *testing.T) {
+	c := cache.New(cache.WithShards(4))
+
+	var mu sync.Mutex
+	loaded := make(map[interface{}]int)
+	loader := func(missing []interface{}) (map[interface{}]interface{}, error) {
+		time.Sleep(10 * time.Millisecond)
+		vals := make(map[interface{}]interface{})
+		mu.Lock()
+		defer mu.Unlock()
+		for _, k := range missing {
+			loaded[k]++
+			vals[k] = k
+		}
+		return vals, nil
+	}
+
+	keys := []interface{}{1, 2, 3, 4, 5, 6, 7, 8}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// every caller asks for an overlapping window of keys
+			ks := keys[i%4 : i%4+4]
+			res, err := c.GetOrComputeMulti(ks, loader)
+			if err != nil || len(res) != len(ks) {
+				t.Errorf("got %v, %v for %v", res, err, ks)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for k, n := range loaded {
+		if n != 1 {
+			t.Errorf("key %v loaded %d times, want 1", k, n)
+		}
+	}
+}
+
+func TestWithLoaderCircuitBreaker(t *testing.T) {
+	c := cache.New(cache.WithLoaderCircuitBreaker(2, 50*time.Millisecond))
+
+	var calls int
+	errDown := errors.New("down")
+	failing := func(key interface{}) (interface{}, error) {
+		calls++
+		return nil, errDown
+	}
+	working := func(key interface{}) (interface{}, error) {
+		calls++
+		return key, nil
+	}
+
+	// closed: failures go through until the threshold is reached
+	for i := 0; i < 2; i++ {
+		if _, err := c.GetOrCompute(i, failing); err != errDown {
+			t.Fatalf("got %v, want %v", err, errDown)
+		}
+	}
+
+	// open: the loader isn't called
+	if _, err := c.GetOrCompute(3, working); err != cache.ErrBreakerOpen {
+		t.Fatalf("got %v, want %v", err, cache.ErrBreakerOpen)
+	}
+	if _, err := c.GetOrComputeMulti([]interface{}{3}, nil); err != cache.ErrBreakerOpen {
+		t.Fatalf("got %v, want %v", err, cache.ErrBreakerOpen)
+	}
+	if calls != 2 {
+		t.Fatalf("loader called %d times, want 2", calls)
+	}
+
+	// half-open: a failed probe reopens the breaker
+	time.Sleep(60 * time.Millisecond)
+	if _, err := c.GetOrCompute(3, failing); err != errDown {
+		t.Fatalf("got %v, want %v", err, errDown)
+	}
+	if _, err := c.GetOrCompute(3, working); err != cache.ErrBreakerOpen {
+		t.Fatalf("got %v, want %v", err, cache.ErrBreakerOpen)
+	}
+
+	// half-open: a successful probe closes it
+	time.Sleep(60 * time.Millisecond)
+	if v, err := c.GetOrCompute(3, working); err != nil || v != 3 {
+		t.Fatalf("got %v, %v; want 3, nil", v, err)
+	}
+	if _, err := c.GetOrCompute(4, failing); err != errDown {
+		t.Fatalf("got %v, want %v", err, errDown)
+	}
+	if calls != 5 {
+		t.Errorf("loader called %d times, want 5", calls)
+	}
+}
+
+func TestCache_InFlightCount(t *testing.T) {
+	c := cache.New(cache.WithShards(4))
+	errBoom := errors.New("boom")
+
+	release := make(chan struct{})
+	loader := func(key interface{}) (interface{}, error) {
+		<-release
+		switch key.(int) % 3 {
+		case 1:
+			return nil, errBoom
+		case 2:
+			panic("boom")
+		}
+		return key, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		for j := 0; j < 3; j++ { // some waiting for others' loads
+			wg.Add(1)
+			go func(key int) {
+				defer wg.Done()
+				defer func() { recover() }()
+				c.GetOrCompute(key, loader)
+			}(i)
+		}
+	}
+	for c.InFlightCount() != 30 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if n := c.InFlightCount(); n != 0 {
+		t.Errorf("got %d loads in flight, want 0", n)
+	}
+	if n := c.Len(); n != 10 {
+		t.Errorf("got len() %d, want 10", n)
+	}
+
+	// the keys that failed can be loaded again
+	if v, err := c.GetOrCompute(2, func(key interface{}) (interface{}, error) {
+		return key, nil
+	}); err != nil || v != 2 {
+		t.Errorf("got %v, %v; want 2, nil", v, err)
+	}
+}
+
+func TestCache_GetOrComputePanic(t *testing.T) {
+	c := cache.New()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	go func() {
+		defer func() { recover() }()
+		c.GetOrCompute("key", func(interface{}) (interface{}, error) {
+			close(started)
+			<-release
+			panic("boom")
+		})
+	}()
+
+	<-started
+	done := make(chan error)
+	go func() {
+		_, err := c.GetOrCompute("key", func(key interface{}) (interface{}, error) {
+			return key, nil
+		})
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond) // let it wait for the first load
+	close(release)
+
+	select {
+	case err := <-done:
+		if err != cache.ErrLoaderPanicked {
+			t.Errorf("got %v, want %v", err, cache.ErrLoaderPanicked)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiter never woke up")
+	}
+}
+
+func TestWithMaxInFlight(t *testing.T) {
+	c := cache.New(cache.WithMaxInFlight(1))
+
+	release := make(chan struct{})
+	go c.GetOrCompute(1, func(key interface{}) (interface{}, error) {
+		<-release
+		return key, nil
+	})
+	for c.InFlightCount() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := c.GetOrCompute(2, nil); err != cache.ErrTooManyInFlight {
+		t.Errorf("got %v, want %v", err, cache.ErrTooManyInFlight)
+	}
+	if _, err := c.GetOrComputeMulti([]interface{}{2}, nil); err != cache.ErrTooManyInFlight {
+		t.Errorf("got %v, want %v", err, cache.ErrTooManyInFlight)
+	}
+
+	close(release)
+	if v, err := c.GetOrCompute(1, nil); err != nil || v != 1 {
+		t.Errorf("got %v, %v; want 1, nil", v, err)
+	}
+	if v, err := c.GetOrCompute(2, func(key interface{}) (interface{}, error) {
+		return key, nil
+	}); err != nil || v != 2 {
+		t.Errorf("got %v, %v; want 2, nil", v, err)
+	}
+}
+
+func TestCache_GetOrReserve(t *testing.T) {
+	c := cache.New()
+
+	_, reserved, commit, ok := c.GetOrReserve("key")
+	if !reserved || ok {
+		t.Fatalf("got reserved=%v, ok=%v; want true, false", reserved, ok)
+	}
+
+	var wg sync.WaitGroup
+	var reservations int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, reserved, _, ok := c.GetOrReserve("key")
+			if reserved {
+				atomic.AddInt32(&reservations, 1)
+			} else if !ok || v != 42 {
+				t.Errorf("got %v, %v; want 42, true", v, ok)
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond) // let them wait for the reservation
+	commit(42, nil)
+	commit(43, nil) // ignored
+	wg.Wait()
+
+	if reservations != 0 {
+		t.Errorf("got %d more reservations, want 0", reservations)
+	}
+	if v, reserved, _, ok := c.GetOrReserve("key"); reserved || !ok || v != 42 {
+		t.Errorf("got %v, %v, %v; want 42, false, true", v, reserved, ok)
+	}
+	if n := c.InFlightCount(); n != 0 {
+		t.Errorf("got %d loads in flight, want 0", n)
+	}
+}
+
+func TestCache_GetOrReserve_failure(t *testing.T) {
+	c := cache.New(cache.WithMaxInFlight(1))
+	errFailed := errors.New("failed")
+
+	_, reserved, commit, _ := c.GetOrReserve("key")
+	if !reserved {
+		t.Fatal("key wasn't reserved")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := c.GetOrCompute("key", func(interface{}) (interface{}, error) {
+			t.Error("loader called while the key was reserved")
+			return nil, nil
+		})
+		if err != errFailed {
+			t.Errorf("got error %v from GetOrCompute, want %v", err, errFailed)
+		}
+	}()
+	time.Sleep(10 * time.Millisecond) // let it wait for the reservation
+	commit(nil, errFailed)
+	<-done
+
+	if _, ok := c.Get("key"); ok {
+		t.Error("got a hit for a failed reservation")
+	}
+	if n := c.InFlightCount(); n != 0 {
+		t.Errorf("got %d loads in flight, want 0", n)
+	}
+
+	// the key can be reserved again
+	_, reserved, commit, ok := c.GetOrReserve("key")
+	if !reserved || ok {
+		t.Fatalf("got reserved=%v, ok=%v; want true, false", reserved, ok)
+	}
+	commit(42, nil)
+	if v, ok := c.Get("key"); !ok || v != 42 {
+		t.Errorf("got %v, %v; want 42, true", v, ok)
+	}
+}
+
+func TestCache_GetWithRefresh(t *testing.T) {
+	c := cache.New(cache.WithTTU(time.Hour))
+	c.Add("key", "old")
+
+	refresh := func(key interface{}) {
+		t.Error("refreshed a fresh entry")
+	}
+	if v, stale, ok := c.GetWithRefresh("key", refresh); v != "old" || stale || !ok {
+		t.Errorf("got %v, %v, %v; want old, false, true", v, stale, ok)
+	}
+
+	c.Invalidate()
+	var calls int32
+	release := make(chan struct{})
+	refresh = func(key interface{}) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		c.Add(key, "new")
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, stale, ok := c.GetWithRefresh("key", refresh); v != "old" || !stale || !ok {
+				t.Errorf("got %v, %v, %v; want old, true, true", v, stale, ok)
+			}
+		}()
+	}
+	wg.Wait()
+	close(release)
+
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		if v, _ := c.Get("key"); v == "new" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("entry wasn't refreshed")
+		}
+	}
+	if calls != 1 {
+		t.Errorf("refresh called %d times, want 1", calls)
+	}
+}
@@ -0,0 +1,84 @@
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+// Logger is used by the cache to log evictions, see WithLogger. It's
+// implemented by *log.Logger.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// evictionLog logs evictions to a Logger. If perSecond is larger than 0, at
+// most perSecond evictions are logged every second, and the ones that aren't
+// are summed up in a single line once the second is over.
+type evictionLog struct {
+	l         Logger
+	perSecond int
+
+	mu         sync.Mutex
+	start      time.Time // when the current second started
+	logged     int       // evictions logged in the current second
+	suppressed int       // evictions not logged since the last summary
+}
+
+// log logs the eviction of key. It must not be called with the lock of a
+// shard held, as the logger may take its time.
+func (el *evictionLog) log(key interface{}) {
+	if el.perSecond <= 0 {
+		el.l.Printf("cache: evicted %v", key)
+		return
+	}
+
+	el.mu.Lock()
+	now := time.Now()
+	if now.Sub(el.start) >= time.Second {
+		el.start, el.logged = now, 0
+	}
+	if el.logged < el.perSecond {
+		el.logged++
+		el.mu.Unlock()
+		el.l.Printf("cache: evicted %v", key)
+		return
+	}
+	if el.suppressed == 0 {
+		time.AfterFunc(el.start.Add(time.Second).Sub(now), el.summarize)
+	}
+	el.suppressed++
+	el.mu.Unlock()
+}
+
+// summarize logs the number of evictions that weren't logged
+func (el *evictionLog) summarize() {
+	el.mu.Lock()
+	n := el.suppressed
+	el.suppressed = 0
+	el.mu.Unlock()
+	el.l.Printf("cache: %d more evictions not logged", n)
+}
+
+// checkBalance logs when the largest of shards holds more than the configured
+// times the average number of entries, see WithImbalanceDetection
+func (c *Cache) checkBalance(shards []*shard) {
+	if c.imbalance <= 0 || c.logger == nil {
+		return
+	}
+
+	total, max, maxIdx := 0, 0, 0
+	for i, s := range shards {
+		n := s.len()
+		total += n
+		if n > max {
+			max, maxIdx = n, i
+		}
+	}
+	if total == 0 {
+		return
+	}
+	avg := float64(total) / float64(len(shards))
+	if r := float64(max) / avg; r > c.imbalance {
+		c.logger.Printf("cache: shard %d holds %d entries, %.1f times the average of %.1f; keys may be unevenly spread", maxIdx, max, r, avg)
+	}
+}
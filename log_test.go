@@ -0,0 +1,92 @@
+package cache_test
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/robteix/cache"
+)
+
+// logRecorder is a cache.Logger that records what is logged
+type logRecorder struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (r *logRecorder) Printf(format string, v ...interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lines = append(r.lines, fmt.Sprintf(format, v...))
+}
+
+func (r *logRecorder) get() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.lines...)
+}
+
+func TestWithLogger(t *testing.T) {
+	var r logRecorder
+	c := cache.New(cache.WithCapacity(1), cache.WithLogger(&r))
+	for i := 0; i < 3; i++ {
+		c.Add(i, i)
+	}
+
+	want := []string{"cache: evicted 0", "cache: evicted 1"}
+	if got := r.get(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestWithEvictionLogSampling(t *testing.T) {
+	var r logRecorder
+	c := cache.New(cache.WithCapacity(1), cache.WithLogger(&r), cache.WithEvictionLogSampling(3))
+	for i := 0; i < 11; i++ {
+		c.Add(i, i)
+	}
+
+	want := []string{"cache: evicted 0", "cache: evicted 1", "cache: evicted 2"}
+	if got := r.get(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	want = append(want, "cache: 7 more evictions not logged")
+	deadline := time.Now().Add(2 * time.Second)
+	for len(r.get()) < len(want) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := r.get(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestWithImbalanceDetection(t *testing.T) {
+	var r logRecorder
+	c := cache.New(cache.WithShards(4), cache.WithLogger(&r), cache.WithImbalanceDetection(2))
+	fill := func(shard int) {
+		for i, n := 0, 0; n < 8; i++ {
+			if c.ShardIndex(i) == shard {
+				c.Add(i, i)
+				n++
+			}
+		}
+	}
+	fill(0)
+	c.Purge()
+
+	want := []string{"cache: shard 0 holds 8 entries, 4.0 times the average of 2.0; keys may be unevenly spread"}
+	if got := r.get(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	for shard := 1; shard < 4; shard++ {
+		fill(shard)
+	}
+	c.Purge()
+	if got := r.get(); len(got) != 1 {
+		t.Errorf("got %q for balanced shards, want no more lines", got)
+	}
+}
@@ -0,0 +1,84 @@
+package cache
+
+// MultiCache presents several caches as one. It works in one of two modes,
+// depending on whether it has a routing function:
+//
+// With a routing function, every key belongs to the cache whose index the
+// function returns for it, and all operations on the key go to that cache
+// only. The MultiCache is then a sharding layer over its caches, which can be
+// configured independently of each other.
+//
+// Without a routing function, the caches form a fallback chain: Get looks the
+// key up in each cache in turn and returns the first value found, while Add
+// adds to the first cache. This suits a small, fast cache in front of larger
+// ones that are filled by other means.
+//
+// A MultiCache is safe for concurrent use, as long as the routing function is.
+type MultiCache struct {
+	caches []*Cache
+	route  func(key interface{}) int
+}
+
+// NewMultiCache creates a MultiCache over caches. If route isn't nil, it must
+// return, for any key, the index in caches of the cache the key belongs to.
+func NewMultiCache(route func(key interface{}) int, caches ...*Cache) *MultiCache {
+	if len(caches) == 0 {
+		panic("a MultiCache needs at least one cache")
+	}
+	return &MultiCache{caches: caches, route: route}
+}
+
+// Get retrieves a value from the cache key belongs to or, without a routing
+// function, from the first cache that has key. It also returns a second value
+// indicating whether the key was found.
+func (m *MultiCache) Get(key interface{}) (value interface{}, ok bool) {
+	if m.route != nil {
+		return m.caches[m.route(key)].Get(key)
+	}
+	for _, c := range m.caches {
+		if value, ok = c.Get(key); ok {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+// Add adds the new keyval pair to the cache key belongs to or, without a
+// routing function, to the first cache.
+func (m *MultiCache) Add(key, val interface{}) {
+	m.caches[m.index(key)].Add(key, val)
+}
+
+// Remove removes key from the cache it belongs to or, without a routing
+// function, from all the caches. It returns the removed value, from the first
+// cache that had key, or nil if none did.
+func (m *MultiCache) Remove(key interface{}) interface{} {
+	if m.route != nil {
+		return m.caches[m.route(key)].Remove(key)
+	}
+	var removed interface{}
+	for _, c := range m.caches {
+		if v := c.Remove(key); removed == nil {
+			removed = v
+		}
+	}
+	return removed
+}
+
+// Len returns the sum of the number of entries of the caches. Without a routing
+// function, keys held by several caches are counted once per cache.
+func (m *MultiCache) Len() int {
+	n := 0
+	for _, c := range m.caches {
+		n += c.Len()
+	}
+	return n
+}
+
+// index returns the index of the cache key is added to
+func (m *MultiCache) index(key interface{}) int {
+	if m.route == nil {
+		return 0
+	}
+	return m.route(key)
+}
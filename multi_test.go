@@ -0,0 +1,50 @@
+package cache_test
+
+import (
+	"testing"
+
+	"github.com/robteix/cache"
+)
+
+func TestMultiCache_Routing(t *testing.T) {
+	even, odd := cache.New(), cache.New()
+	m := cache.NewMultiCache(func(key interface{}) int { return key.(int) % 2 }, even, odd)
+	for i := 0; i < 10; i++ {
+		m.Add(i, i)
+	}
+
+	if even.Len() != 5 || odd.Len() != 5 || m.Len() != 10 {
+		t.Fatalf("got lens %d and %d, total %d; want 5, 5 and 10", even.Len(), odd.Len(), m.Len())
+	}
+	if _, ok := odd.Get(2); ok {
+		t.Error("2 was added to the wrong cache")
+	}
+	if v, ok := m.Get(3); !ok || v != 3 {
+		t.Errorf("got %v, %v; want 3, true", v, ok)
+	}
+	if v := m.Remove(3); v != 3 || odd.Len() != 4 {
+		t.Errorf("got %v removed and %d left; want 3 and 4", v, odd.Len())
+	}
+}
+
+func TestMultiCache_Fallback(t *testing.T) {
+	front, back := cache.New(), cache.New()
+	m := cache.NewMultiCache(nil, front, back)
+	back.Add("a", "back")
+	back.Add("b", "back")
+	m.Add("a", "front")
+
+	if v, ok := m.Get("a"); !ok || v != "front" {
+		t.Errorf("got %v, %v; want front, true", v, ok)
+	}
+	if v, ok := m.Get("b"); !ok || v != "back" {
+		t.Errorf("got %v, %v; want back, true", v, ok)
+	}
+	if _, ok := m.Get("c"); ok {
+		t.Error("found a missing key")
+	}
+
+	if v := m.Remove("a"); v != "front" || front.Len() != 0 || back.Len() != 1 {
+		t.Errorf("got %v removed, lens %d and %d; want front, 0 and 1", v, front.Len(), back.Len())
+	}
+}
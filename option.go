@@ -1,6 +1,7 @@
 package cache
 
 import (
+	"math/rand"
 	"time"
 )
 
@@ -17,15 +18,45 @@ func (f optionFunc) apply(c *Cache) {
 }
 
 // WithCapacity configures the max capacity of each shard. If cap is 0, then
-// there is no set capacity and the cache will grow indefinely
+// there is no set capacity and the cache will grow indefinely. Note that a
+// cache with several shards can hold up to cap times the number of shards
+// entries; use WithTotalCapacity to bound the cache as a whole.
 func WithCapacity(cap int) Option {
 	return optionFunc(func(c *Cache) {
 		c.cap = cap
 	})
 }
 
+// WithTotalCapacity configures the max capacity of the whole cache, regardless
+// of the number of shards. The capacity is divided across shards, rounding up,
+// and when the cache is full, adding an entry evicts one, from the shard of
+// the new entry if it has any and from the other shards otherwise, so the
+// cache never holds more than n entries once Add returns. It overrides
+// WithCapacity. n must be larger than 0.
+func WithTotalCapacity(n int) Option {
+	return optionFunc(func(c *Cache) {
+		if n < 1 {
+			panic("the total capacity must be larger than 0")
+		}
+		c.totalCap = n
+	})
+}
+
+// WithDisabled configures the cache to store nothing: adding entries has no
+// effect, so every lookup is a miss. This allows turning caching off, for
+// instance behind a feature flag, without changing the code that uses the
+// cache. Note that a capacity of 0 doesn't disable the cache, but rather makes
+// it unbounded.
+func WithDisabled() Option {
+	return optionFunc(func(c *Cache) {
+		c.disabled = true
+	})
+}
+
 // WithShards configures the number of shards to split the cache. This number
-// must be larger than 0. By default, the cache uses a single shard.
+// must be larger than 0. By default, the cache uses a single shard. Any number
+// spreads keys evenly, but assigning keys to shards is slightly cheaper when
+// it's a power of two.
 func WithShards(n int32) Option {
 	return optionFunc(func(c *Cache) {
 		if n < 1 {
@@ -42,3 +73,326 @@ func WithTTU(ttu time.Duration) Option {
 		c.ttu = ttu
 	})
 }
+
+// WithCoolOff configures the cache not to move an entry to the front of the LRU
+// list when it's used within d of the last time it was moved there, or added.
+// Reads of hot entries then skip the list manipulation, which saves work under
+// the shard lock, at the cost of a less precise LRU order.
+//
+// Uses during the cool-off don't update the last used time of the entry
+// either, so that the list stays ordered by last used time. An entry that is
+// only used within the cool-off thus expires a TTU after the use that last
+// moved it; d should be well below the TTU so that hot entries don't expire.
+func WithCoolOff(d time.Duration) Option {
+	return optionFunc(func(c *Cache) {
+		c.coolOff = d
+	})
+}
+
+// WithFixedTTL configures the cache to expire entries once ttl has elapsed
+// since their value was set, however often they're read. Unlike the TTU, which
+// is renewed by every read, this makes frequently read entries refresh on a
+// schedule. Capacity evictions are still based on last use.
+//
+// Both may be used together, in which case entries expire as soon as either
+// has elapsed.
+func WithFixedTTL(ttl time.Duration) Option {
+	return optionFunc(func(c *Cache) {
+		c.fixedTTL = ttl
+	})
+}
+
+// WithReadValidator configures the cache to validate entries as they're read by
+// Get. If valid returns false, the entry is removed and Get reports a miss.
+// This allows entries to be invalidated by conditions other than their age,
+// such as external state changing.
+//
+// The validator is called without holding any of the cache's locks, so it may
+// safely use the cache itself.
+func WithReadValidator(valid func(key, value interface{}) bool) Option {
+	return optionFunc(func(c *Cache) {
+		c.validate = valid
+	})
+}
+
+// WithProtectHot configures the cache to use a segmented LRU: entries start in
+// a probation segment and, once they've been read n times, are moved to a
+// protected segment. Protected entries are never moved again on access, so
+// reading them is cheaper, and they are only evicted to make room for others
+// once the probation segment is empty. They still expire once their TTU, which
+// isn't renewed by reads, lapses.
+//
+// The protected segment of each shard may hold up to 80% of the shard's
+// capacity, so that new entries always have room to prove themselves. When a
+// promotion overflows it, its least recently used entry is demoted back to the
+// front of the probation segment. Caches with no capacity have an unbounded
+// protected segment, and shards with a capacity of 1 never protect entries.
+func WithProtectHot(n int) Option {
+	return optionFunc(func(c *Cache) {
+		c.protectAt = n
+	})
+}
+
+// WithContentionTracking configures the cache to count, for each shard, how
+// many times its lock was already held when a goroutine tried to acquire it.
+// The counts are available through ShardContention.
+//
+// Contention is detected by trying to acquire the lock without blocking before
+// falling back to waiting for it. This measures how often goroutines collide,
+// not how long they wait. The cost is an extra atomic operation whenever the
+// lock is contended and an atomic increment of the shard's counter.
+func WithContentionTracking() Option {
+	return optionFunc(func(c *Cache) {
+		c.trackContention = true
+	})
+}
+
+// WithFallback configures the cache to consult src whenever a key is missing
+// from the cache itself. If src has the key, its value is added to the cache,
+// subject to its capacity and TTU like any other entry, and returned. This
+// allows layering a local cache over a slower one, which could be another
+// Cache or a wrapper around a remote cache client.
+//
+// The fallback is only consulted by Get and only when the key is missing or
+// expired locally. The local miss is still counted in the cache's statistics.
+func WithFallback(src Source) Option {
+	return optionFunc(func(c *Cache) {
+		c.fallback = src
+	})
+}
+
+// WithEqualityFunc configures the cache to compare the new value of an existing
+// key with the old one when it's added again. If equal reports them as equal,
+// the update is a no-op: the entry is neither moved to the front of the LRU
+// list nor has its last used time renewed. This saves work for idempotent
+// writes and keeps them from extending the life of entries in caches with a TTU.
+//
+// By default, values are not compared and every Add counts as a use.
+func WithEqualityFunc(equal func(old, new interface{}) bool) Option {
+	return optionFunc(func(c *Cache) {
+		c.equal = equal
+	})
+}
+
+// Policy determines which entry is evicted when a shard is over capacity
+type Policy int
+
+const (
+	// PolicyLRU evicts the least recently used entry. This is the default.
+	PolicyLRU Policy = iota
+
+	// PolicyEvictNewest evicts the most recently used entry, other than the
+	// one just added. This favors established entries over new ones, which
+	// makes the cache resist being churned by bursts of new data: each new
+	// entry takes the place of the previous newcomer.
+	PolicyEvictNewest
+)
+
+// WithPolicy configures the eviction policy of the cache. The policy only
+// affects which entries are evicted when adding entries to a full shard. Other
+// ways of removing entries, such as TrimTo, always remove the least recently
+// used ones.
+func WithPolicy(p Policy) Option {
+	return optionFunc(func(c *Cache) {
+		c.policy = p
+	})
+}
+
+// WithManualEviction disables the automatic eviction of entries when adding to
+// a full shard. The capacity becomes a soft limit: shards may grow beyond it,
+// holding on to the memory of the extra entries, until Evict is called. This
+// allows evictions to be batched and run on a schedule of the caller's choice.
+func WithManualEviction() Option {
+	return optionFunc(func(c *Cache) {
+		c.manualEviction = true
+	})
+}
+
+// WithLoaderCircuitBreaker configures a circuit breaker around the loaders
+// called by GetOrCompute and GetOrComputeMulti. After failureThreshold
+// consecutive loader failures, the breaker opens and loaders aren't called for
+// the duration of cooldown; ErrBreakerOpen is returned instead. This keeps a
+// struggling backing store from being flooded with requests on every miss.
+//
+// Once cooldown has elapsed, a single loader call is let through as a probe.
+// If it succeeds, the breaker closes; otherwise it opens for another cooldown.
+// The breaker is shared by all keys of the cache.
+func WithLoaderCircuitBreaker(failureThreshold int, cooldown time.Duration) Option {
+	return optionFunc(func(c *Cache) {
+		if failureThreshold < 1 {
+			panic("the failure threshold must be larger than 0")
+		}
+		c.breaker = &breaker{threshold: failureThreshold, cooldown: cooldown}
+	})
+}
+
+// WithMaxInFlight limits the number of loads that GetOrCompute and
+// GetOrComputeMulti may have in flight at once, across all keys of the cache.
+// Once n loads are in flight, loading another key fails with
+// ErrTooManyInFlight until some of them complete. Callers waiting for a key
+// that is already being loaded aren't affected.
+func WithMaxInFlight(n int) Option {
+	return optionFunc(func(c *Cache) {
+		if n < 1 {
+			panic("the max number of loads in flight must be larger than 0")
+		}
+		c.maxInFlight = n
+	})
+}
+
+// WithCloseHandler configures a handler that Close calls, exactly once, with
+// the entries left in the cache, so that they can be persisted or flushed
+// elsewhere before the cache goes away. Entries are grouped by shard, in shard
+// index order, and the entries of each shard are ordered from the least to the
+// most recently used, with the protected ones, see WithProtectHot, last.
+// Expired entries are left out.
+//
+// The handler is called after the locks of the cache are released, so it may
+// use the cache, which is empty by then.
+func WithCloseHandler(handle func(entries []Element)) Option {
+	return optionFunc(func(c *Cache) {
+		c.closeHandler = handle
+	})
+}
+
+// WithLogger configures the cache to log to l every entry it evicts to make
+// room for others. Lines are logged after the locks of the cache are released,
+// on the goroutine that caused the eviction. See WithEvictionLogSampling to
+// keep a cache that is under pressure from flooding the log.
+func WithLogger(l Logger) Option {
+	return optionFunc(func(c *Cache) {
+		c.logger = l
+	})
+}
+
+// WithEvictionLogSampling limits the evictions logged by the cache, see
+// WithLogger, to perSecond every second. Evictions beyond that aren't logged
+// individually; instead, a line with how many weren't logged is logged when
+// the second is over. If perSecond is 0, every eviction is logged.
+func WithEvictionLogSampling(perSecond int) Option {
+	return optionFunc(func(c *Cache) {
+		if perSecond < 0 {
+			panic("the evictions logged per second can't be negative")
+		}
+		c.logSampling = perSecond
+	})
+}
+
+// WithImbalanceDetection configures the cache to log, see WithLogger, when its
+// largest shard holds more than threshold times the average number of entries
+// per shard. That hints at keys that hash poorly or are skewed, which makes the
+// crowded shard evict early, as the capacity applies to each shard, and puts
+// most of the contention on its lock.
+//
+// The check is done at the end of every Purge and PurgeWithBudget, including
+// the ones of StartPurger, but not by rolling purgers. It locks each shard
+// briefly to count its entries. Without a logger, there is no check.
+func WithImbalanceDetection(threshold float64) Option {
+	return optionFunc(func(c *Cache) {
+		if threshold <= 1 {
+			panic("the imbalance threshold must be larger than 1")
+		}
+		c.imbalance = threshold
+	})
+}
+
+// WithCopier configures the cache to return copies of its values, made by
+// calling copy, from Get, GetStale and GetOrCompute. This keeps callers from
+// modifying the values held by the cache, at the cost of a copy per read.
+// Values implementing Immutable are returned without being copied.
+func WithCopier(copy func(value interface{}) interface{}) Option {
+	return optionFunc(func(c *Cache) {
+		c.copier = copy
+	})
+}
+
+// WithOnEvict configures the cache to call onEvict with the key and value of
+// every entry it removes, and why, so that resources held by values can be
+// released. Unlike the callbacks of AddWithCallback, it also applies to values
+// replaced by adding their key again, with ReasonReplaced, unless the
+// equality function, see WithEqualityFunc, finds the new value equal to the
+// old one. Values replaced with Rename are reported as removed.
+//
+// onEvict is called after the locks of the cache are released, on the
+// goroutine that caused the removal, so it may use the cache.
+func WithOnEvict(onEvict func(key, value interface{}, reason EvictReason)) Option {
+	return optionFunc(func(c *Cache) {
+		c.onEvict = onEvict
+	})
+}
+
+// WithEvictionHistory configures the cache to remember its last size removals
+// of entries, whether evicted, expired or removed, along with when and why they
+// happened. They are available through RecentEvictions and WasRecentlyEvicted,
+// which help explain unexpected misses.
+func WithEvictionHistory(size int) Option {
+	return optionFunc(func(c *Cache) {
+		if size < 1 {
+			panic("the eviction history size must be larger than 0")
+		}
+		c.history = newHistory(size)
+	})
+}
+
+// WithHashSeed configures the cache to hash keys with seed when assigning them
+// to shards. Without a seed, the assignment is predictable, so someone choosing
+// the keys, such as clients of a server whose cache is keyed by request paths,
+// could craft keys that all land in the same shard, leaving it to do all the
+// work behind a single lock. Seeding with a secret value makes that much
+// harder.
+//
+// Caches with different seeds assign keys to different shards. To keep the
+// assignment across restarts, save the seed, see HashSeed, and use it again.
+func WithHashSeed(seed uint64) Option {
+	return optionFunc(func(c *Cache) {
+		c.seed, c.seeded = seed, true
+	})
+}
+
+// WithRandomSeed is like WithHashSeed, with a random seed. Shard assignments
+// are therefore different each time the program runs, unless the seed is
+// saved, see HashSeed, and given to WithHashSeed.
+func WithRandomSeed() Option {
+	return optionFunc(func(c *Cache) {
+		c.randomSeed = true
+	})
+}
+
+// WithRand configures the cache to draw all of its random decisions, such as
+// the seed picked by WithRandomSeed, from r, which makes them reproducible in
+// tests and fuzzing. By default, each cache has its own source, seeded with an
+// unpredictable value. The cache serializes its use of r, which must not be
+// used elsewhere.
+func WithRand(r *rand.Rand) Option {
+	return optionFunc(func(c *Cache) {
+		c.rnd = r
+	})
+}
+
+// WithLenientGet configures Get to report a miss for keys that can't be
+// hashed, rather than panicking. Keys of types this package doesn't know how to
+// hash are gob-encoded, which fails for some types, such as functions and
+// channels. Such keys can never be added to the cache, so a miss is the right
+// answer for them, which makes Get safe to use with keys from untrusted
+// sources. Other methods, such as Add, still panic, since failing to store a
+// value silently would hide the error.
+func WithLenientGet() Option {
+	return optionFunc(func(c *Cache) {
+		c.lenientGet = true
+	})
+}
+
+// WithCapacityObserver configures the cache to call observe with the index of
+// a shard when it starts evicting entries to stay within its capacity. This is
+// an early sign that the cache is under pressure. The observer is called once
+// when a shard first evicts an entry, and not again until the shard has dropped
+// below its capacity, for instance because entries expired or were removed,
+// and then fills up again.
+//
+// The observer is called after the locks of the cache are released, on the
+// goroutine that caused the eviction, so it may use the cache.
+func WithCapacityObserver(observe func(shardIdx int)) Option {
+	return optionFunc(func(c *Cache) {
+		c.capObserver = observe
+	})
+}
@@ -0,0 +1,79 @@
+package cache
+
+import "sync/atomic"
+
+// Priority determines the order in which entries are evicted when a shard is
+// over capacity: entries are only evicted once there are no entries of a lower
+// priority left. Within a priority, the eviction policy applies.
+type Priority int
+
+const (
+	// PriorityDisposable entries are evicted before any others
+	PriorityDisposable Priority = iota - 1
+	// PriorityNormal is the priority of the entries added with Add
+	PriorityNormal
+	// PriorityCritical entries are only evicted once there are no others
+	PriorityCritical
+)
+
+// AddWithPriority is like Add, but it also sets the priority of the entry.
+// Adding the key again with Add only replaces the value, and keeps the
+// priority; adding it with AddWithPriority replaces both.
+//
+// If the shard of key is full and all its entries have a higher priority than
+// the new one, the new entry would be the first to be evicted, so it isn't
+// added at all.
+//
+// Once entries with a priority other than PriorityNormal are added, finding an
+// entry to evict takes a scan of the shard, so evictions get slower as shards
+// get larger.
+func (c *Cache) AddWithPriority(key, val interface{}, priority Priority) {
+	c.init()
+	if priority != PriorityNormal {
+		atomic.StoreInt32(&c.hasPriorities, 1)
+	}
+
+	s := c.shard(key)
+	s.Lock()
+	defer s.Unlock()
+
+	if _, found := s.idx[key]; !found && c.cap > 0 && !c.manualEviction && s.count() >= c.cap {
+		if victim := s.victim(); victim != nil && victim.priority > priority {
+			return
+		}
+	}
+	s.set(key, val)
+	if ce, found := s.idx[key]; found {
+		ce.priority = priority
+	}
+}
+
+// prioritized reports whether entries may have priorities other than
+// PriorityNormal
+func (c *Cache) prioritized() bool {
+	return atomic.LoadInt32(&c.hasPriorities) != 0
+}
+
+// returns the first entry of the lowest priority found going through the
+// probation segment and then the protected one, either from the back of each
+// list or from the front. Caller must hold the mutex.
+func (s *shard) lowestPriority(fromBack bool) *cacheEntry {
+	var low *cacheEntry
+	for _, l := range []*entryList{s.l, s.prot} {
+		ce := l.Front()
+		if fromBack {
+			ce = l.Back()
+		}
+		for ce != nil {
+			if low == nil || ce.priority < low.priority {
+				low = ce
+			}
+			if fromBack {
+				ce = ce.Prev()
+			} else {
+				ce = ce.Next()
+			}
+		}
+	}
+	return low
+}
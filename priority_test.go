@@ -0,0 +1,77 @@
+package cache_test
+
+import (
+	"testing"
+
+	"github.com/robteix/cache"
+)
+
+func TestCache_AddWithPriority(t *testing.T) {
+	c := cache.New(cache.WithCapacity(6))
+	c.AddWithPriority("c1", 1, cache.PriorityCritical)
+	c.AddWithPriority("c2", 2, cache.PriorityCritical)
+	c.Add("n1", 1)
+	c.Add("n2", 2)
+	c.AddWithPriority("d1", 1, cache.PriorityDisposable)
+	c.AddWithPriority("d2", 2, cache.PriorityDisposable)
+
+	// use the oldest ones so that recency alone would evict the others
+	c.Get("c1")
+	c.Get("c2")
+	c.Get("n1")
+	c.Get("n2")
+
+	steps := []struct {
+		key  string
+		gone []string
+	}{
+		{"x1", []string{"d1"}},
+		{"x2", []string{"d1", "d2"}},
+		{"x3", []string{"d1", "d2", "n1"}},
+		{"x4", []string{"d1", "d2", "n1", "n2"}},
+		{"x5", []string{"d1", "d2", "n1", "n2", "x1"}},
+	}
+	for _, step := range steps {
+		c.Add(step.key, 0)
+		for _, key := range step.gone {
+			if c.Contains(key) {
+				t.Errorf("after adding %s: %s wasn't evicted", step.key, key)
+			}
+		}
+		for _, key := range []string{"c1", "c2"} {
+			if !c.Contains(key) {
+				t.Errorf("after adding %s: %s was evicted", step.key, key)
+			}
+		}
+	}
+
+	// critical entries go once there are no others
+	c.AddWithPriority("c3", 3, cache.PriorityCritical)
+	c.AddWithPriority("c4", 4, cache.PriorityCritical)
+	c.AddWithPriority("c5", 5, cache.PriorityCritical)
+	c.AddWithPriority("c6", 6, cache.PriorityCritical)
+	c.AddWithPriority("c7", 7, cache.PriorityCritical)
+	if c.Contains("c1") || !c.Contains("c2") || !c.Contains("c7") {
+		t.Errorf("got keys %v, want c1 evicted first", c.Keys())
+	}
+}
+
+func TestCache_AddWithPriorityLower(t *testing.T) {
+	c := cache.New(cache.WithCapacity(2))
+	c.Add(1, 1)
+	c.Add(2, 2)
+
+	// there's nothing of a lower priority to make room for it
+	c.AddWithPriority(3, 3, cache.PriorityDisposable)
+	if c.Contains(3) || c.Len() != 2 {
+		t.Errorf("got keys %v, want [2 1]", c.Keys())
+	}
+
+	// the priority is kept when updated with Add
+	c.AddWithPriority(1, 1, cache.PriorityDisposable)
+	c.Add(1, 10)
+	c.Add(4, 4)
+	if c.Contains(1) {
+		t.Errorf("got keys %v, want 1 evicted", c.Keys())
+	}
+}
@@ -0,0 +1,29 @@
+package cache
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"math/rand"
+)
+
+// random returns a random number from the cache's source of randomness, see
+// WithRand. Every randomized decision the cache makes must draw from it, so
+// that they can be reproduced.
+func (c *Cache) random() uint64 {
+	c.rndMu.Lock()
+	defer c.rndMu.Unlock()
+
+	if c.rnd == nil {
+		c.rnd = rand.New(rand.NewSource(int64(cryptoSeed())))
+	}
+	return c.rnd.Uint64()
+}
+
+// cryptoSeed returns an unpredictable seed
+func cryptoSeed() uint64 {
+	var b [8]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		panic("could not generate a random seed: " + err.Error())
+	}
+	return binary.LittleEndian.Uint64(b[:])
+}
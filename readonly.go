@@ -0,0 +1,30 @@
+package cache
+
+// ReadOnlyCache is the subset of the Cache methods that don't modify its
+// contents. It allows handing a cache to code that should only read from it.
+//
+// Reads through Get still count as uses of the entries, so they affect which
+// entries are evicted, and may add entries retrieved from a fallback source.
+type ReadOnlyCache interface {
+	Get(key interface{}) (value interface{}, ok bool)
+	Peek(key interface{}) (value interface{}, ok bool)
+	Contains(key interface{}) bool
+	Len() int
+	Keys() []interface{}
+}
+
+// readOnly wraps a Cache so that it can't be converted back into one
+type readOnly struct {
+	c *Cache
+}
+
+// ReadOnly returns a read-only view of the cache
+func (c *Cache) ReadOnly() ReadOnlyCache {
+	return readOnly{c}
+}
+
+func (r readOnly) Get(key interface{}) (interface{}, bool)  { return r.c.Get(key) }
+func (r readOnly) Peek(key interface{}) (interface{}, bool) { return r.c.Peek(key) }
+func (r readOnly) Contains(key interface{}) bool            { return r.c.Contains(key) }
+func (r readOnly) Len() int                                 { return r.c.Len() }
+func (r readOnly) Keys() []interface{}                      { return r.c.Keys() }
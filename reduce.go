@@ -0,0 +1,90 @@
+package cache
+
+import "sync/atomic"
+
+// AddReducible is like Add, but the entry can later be reduced by Reduce: its
+// full value replaced with reduce(full), a cheaper stand-in such as an ID to
+// load the full value from, rather than the whole entry being evicted. Adding
+// the key again with Add replaces the value, which is then no longer reduced,
+// and keeps reduce; adding it with AddReducible replaces both.
+//
+// Get returns the value of the entry, whether it's reduced or not, and
+// GetReducible also tells which. A reduced entry is restored by adding its full
+// value again, or by replacing it in place, with GetAndUpdate or UpdateFunc,
+// whose results are taken as full values.
+func (c *Cache) AddReducible(key, full interface{}, reduce func(full interface{}) interface{}) {
+	c.init()
+	s := c.shard(key)
+	s.Lock()
+	defer s.Unlock()
+
+	s.set(key, full)
+	if ce, found := s.idx[key]; found {
+		ce.reduce = reduce
+		ce.reduced = false
+	}
+}
+
+// GetReducible is like Get, but it also returns whether the value was reduced,
+// see AddReducible.
+func (c *Cache) GetReducible(key interface{}) (value interface{}, reduced, ok bool) {
+	c.init()
+	value, reduced, ok = c.shard(key).getReducible(key)
+	if ok {
+		value = c.copy(value)
+	}
+	return value, reduced, ok
+}
+
+// Reduce reduces up to n entries in each shard, see AddReducible, starting from
+// the least recently used, and returns how many were reduced. Entries that were
+// added with Add, or that are already reduced, are skipped. Reduce is meant to
+// be called when memory is short, to free some without losing entries. The
+// recency of the entries isn't changed. Reduced entries are sized again by the
+// coster, see WithCoster.
+func (c *Cache) Reduce(n int) int {
+	c.init()
+
+	reduced := 0
+	for _, s := range c.allShards() {
+		reduced += s.reduce(n)
+	}
+	return reduced
+}
+
+// like get, but also returns whether the value was reduced
+func (s *shard) getReducible(key interface{}) (value interface{}, reduced, ok bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	ce, found := s.idx[key]
+	if !found || s.expired(ce) {
+		atomic.AddUint64(&s.misses, 1)
+		return nil, false, false
+	}
+	atomic.AddUint64(&s.hits, 1)
+	s.use(ce)
+	return ce.val, ce.reduced, true
+}
+
+// reduces up to n of the least recently used entries that can be reduced,
+// returning how many were
+func (s *shard) reduce(n int) int {
+	s.Lock()
+	defer s.Unlock()
+
+	reduced := 0
+	for _, l := range []*entryList{s.l, s.prot} {
+		for ce := l.Back(); ce != nil && reduced < n; ce = ce.Prev() {
+			if ce.reduce == nil || ce.reduced || s.expired(ce) {
+				continue
+			}
+			ce.val = ce.reduce(ce.val)
+			ce.reduced = true
+			s.recost(ce)
+			reduced++
+		}
+	}
+	s.evictOverBytes()
+	return reduced
+}
@@ -0,0 +1,71 @@
+package cache_test
+
+import (
+	"testing"
+
+	"github.com/robteix/cache"
+)
+
+type session struct {
+	id   int
+	data []byte
+}
+
+func TestCache_Reduce(t *testing.T) {
+	c := cache.New()
+	toID := func(full interface{}) interface{} { return full.(*session).id }
+	for i := 0; i < 4; i++ {
+		c.AddReducible(i, &session{id: i, data: make([]byte, 1024)}, toID)
+	}
+	c.Add("plain", 1) // can't be reduced
+	c.Get(0)
+
+	if n := c.Reduce(2); n != 2 {
+		t.Fatalf("reduced %d entries, want 2", n)
+	}
+	for i := 0; i < 4; i++ {
+		v, reduced, ok := c.GetReducible(i)
+		if !ok {
+			t.Fatalf("%d was evicted", i)
+		}
+		if want := i == 1 || i == 2; reduced != want {
+			t.Errorf("got reduced %v for %d, want %v", reduced, i, want)
+		}
+		if reduced && v != i {
+			t.Errorf("got %v for reduced %d, want %d", v, i, i)
+		}
+	}
+
+	// restoring the full value
+	c.Add(1, &session{id: 1})
+	if v, reduced, _ := c.GetReducible(1); reduced || v.(*session).id != 1 {
+		t.Errorf("got %v, %v; want the full value", v, reduced)
+	}
+
+	if n := c.Reduce(10); n != 3 {
+		t.Errorf("reduced %d entries, want 3", n)
+	}
+	if _, reduced, _ := c.GetReducible("plain"); reduced {
+		t.Error("reduced an entry added with Add")
+	}
+}
+
+func TestCache_ReduceUpdated(t *testing.T) {
+	c := cache.New()
+	toID := func(full interface{}) interface{} { return full.(*session).id }
+	c.AddReducible(1, &session{id: 1}, toID)
+	c.AddReducible(2, &session{id: 2}, toID)
+	c.Reduce(1)
+	c.Reduce(1)
+
+	c.GetAndUpdate(1, func(interface{}) interface{} { return &session{id: 1} })
+	if v, reduced, _ := c.GetReducible(1); reduced || v.(*session).id != 1 {
+		t.Errorf("got %v, %v after GetAndUpdate; want the full value", v, reduced)
+	}
+	c.UpdateFunc(func(key, _ interface{}) bool { return key == 2 }, func(interface{}) interface{} {
+		return &session{id: 2}
+	})
+	if v, reduced, _ := c.GetReducible(2); reduced || v.(*session).id != 2 {
+		t.Errorf("got %v, %v after UpdateFunc; want the full value", v, reduced)
+	}
+}
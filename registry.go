@@ -0,0 +1,66 @@
+package cache
+
+import (
+	"fmt"
+	"sync"
+)
+
+// the caches created with WithRegistration, by name
+var (
+	registryMu sync.Mutex
+	registry   = make(map[string]*Cache)
+)
+
+// WithRegistration registers the cache under name in a process-wide registry,
+// so that it can be found through Registered, for instance by an admin
+// handler reporting on every cache of the program. The cache stays registered
+// until it's closed with Close, and the registry holds a reference to it until
+// then, so a registered cache that is dropped without being closed is never
+// garbage collected. Registration is opt-in for that reason.
+//
+// New panics if another cache is already registered under name.
+func WithRegistration(name string) Option {
+	return optionFunc(func(c *Cache) {
+		c.regName = name
+	})
+}
+
+// Registered returns the caches registered with WithRegistration that haven't
+// been closed yet, by name. The map is a copy, which the caller may modify.
+func Registered() map[string]*Cache {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	caches := make(map[string]*Cache, len(registry))
+	for name, c := range registry {
+		caches[name] = c
+	}
+	return caches
+}
+
+// register adds c to the registry, if it's configured with a name
+func (c *Cache) register() {
+	if c.regName == "" {
+		return
+	}
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, found := registry[c.regName]; found {
+		panic(fmt.Sprintf("a cache is already registered as %q", c.regName))
+	}
+	registry[c.regName] = c
+}
+
+// unregister removes c from the registry, if it's there
+func (c *Cache) unregister() {
+	if c.regName == "" {
+		return
+	}
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if registry[c.regName] == c {
+		delete(registry, c.regName)
+	}
+}
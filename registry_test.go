@@ -0,0 +1,34 @@
+package cache_test
+
+import (
+	"testing"
+
+	"github.com/robteix/cache"
+)
+
+func TestWithRegistration(t *testing.T) {
+	a := cache.New(cache.WithRegistration("test-a"))
+	b := cache.New(cache.WithRegistration("test-b"))
+	cache.New() // not registered
+
+	got := cache.Registered()
+	if got["test-a"] != a || got["test-b"] != b {
+		t.Fatalf("got %v, want test-a and test-b", got)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("no panic for a name already registered")
+			}
+		}()
+		cache.New(cache.WithRegistration("test-a"))
+	}()
+
+	a.Close()
+	got = cache.Registered()
+	if _, found := got["test-a"]; found || got["test-b"] != b {
+		t.Errorf("got %v after closing test-a, want test-b only", got)
+	}
+	b.Close()
+}
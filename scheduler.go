@@ -0,0 +1,173 @@
+package cache
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// PurgeScheduler purges any number of caches, each at its own frequency, from
+// a single goroutine. It's an alternative to calling StartPurger on each cache
+// for programs with many caches, which would otherwise need a goroutine and a
+// ticker per cache.
+//
+// A PurgeScheduler is safe for concurrent use. Its goroutine runs until Stop
+// is called.
+type PurgeScheduler struct {
+	mu   sync.Mutex
+	jobs map[*Cache]*purgeJob // the registered caches
+	q    purgeQueue           // the registered caches, by next purge
+
+	wake chan struct{} // signals that the queue changed
+	done chan struct{} // closed by Stop
+	once sync.Once
+}
+
+// purgeJob is a cache registered with a PurgeScheduler
+type purgeJob struct {
+	c     *Cache
+	freq  time.Duration
+	next  time.Time // when to purge next
+	index int       // index in the queue
+}
+
+// NewPurgeScheduler creates a PurgeScheduler and starts its goroutine
+func NewPurgeScheduler() *PurgeScheduler {
+	p := &PurgeScheduler{
+		jobs: make(map[*Cache]*purgeJob),
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// Register schedules c to be purged at the provided freq, starting freq from
+// now. Registering a cache again changes its frequency. freq must be larger
+// than 0.
+func (p *PurgeScheduler) Register(c *Cache, freq time.Duration) {
+	if freq <= 0 {
+		panic("the purge frequency must be larger than 0")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	next := time.Now().Add(freq)
+	if j, ok := p.jobs[c]; ok {
+		j.freq, j.next = freq, next
+		heap.Fix(&p.q, j.index)
+	} else {
+		j := &purgeJob{c: c, freq: freq, next: next}
+		p.jobs[c] = j
+		heap.Push(&p.q, j)
+	}
+	p.signal()
+}
+
+// Unregister stops purging c. It's a no-op if c isn't registered. If c is
+// unregistered while the scheduler is purging other caches, it won't be purged
+// anymore, but a purge of c that has already started runs to completion.
+func (p *PurgeScheduler) Unregister(c *Cache) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if j, ok := p.jobs[c]; ok {
+		heap.Remove(&p.q, j.index)
+		delete(p.jobs, c)
+		p.signal()
+	}
+}
+
+// Stop stops the scheduler's goroutine. It's safe to call Stop more than once.
+func (p *PurgeScheduler) Stop() {
+	p.once.Do(func() { close(p.done) })
+}
+
+// signal wakes up the goroutine so it can recompute when to purge next. Caller
+// must hold the mutex.
+func (p *PurgeScheduler) signal() {
+	select {
+	case p.wake <- struct{}{}:
+	default: // already signalled
+	}
+}
+
+func (p *PurgeScheduler) run() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		p.mu.Lock()
+		var wait <-chan time.Time // nil, blocking forever, if nothing is registered
+		if len(p.q) > 0 {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(time.Until(p.q[0].next))
+			wait = timer.C
+		}
+		p.mu.Unlock()
+
+		select {
+		case <-p.done:
+			return
+		case <-p.wake:
+		case <-wait:
+			for _, c := range p.due() {
+				// it may have been unregistered in the meantime
+				p.mu.Lock()
+				_, ok := p.jobs[c]
+				p.mu.Unlock()
+				if ok {
+					c.Purge()
+				}
+			}
+		}
+	}
+}
+
+// due returns the caches that are due for a purge and reschedules them
+func (p *PurgeScheduler) due() []*Cache {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var cs []*Cache
+	now := time.Now()
+	for len(p.q) > 0 && !p.q[0].next.After(now) {
+		j := p.q[0]
+		cs = append(cs, j.c)
+		j.next = now.Add(j.freq)
+		heap.Fix(&p.q, 0)
+	}
+	return cs
+}
+
+// purgeQueue implements heap.Interface to keep jobs ordered by their next purge
+type purgeQueue []*purgeJob
+
+func (q purgeQueue) Len() int           { return len(q) }
+func (q purgeQueue) Less(i, j int) bool { return q[i].next.Before(q[j].next) }
+
+func (q purgeQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *purgeQueue) Push(x interface{}) {
+	j := x.(*purgeJob)
+	j.index = len(*q)
+	*q = append(*q, j)
+}
+
+func (q *purgeQueue) Pop() interface{} {
+	old := *q
+	j := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return j
+}
@@ -0,0 +1,61 @@
+package cache_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/robteix/cache"
+)
+
+func TestPurgeScheduler(t *testing.T) {
+	p := cache.NewPurgeScheduler()
+	defer p.Stop()
+
+	var cs []*cache.Cache
+	for i := 0; i < 3; i++ {
+		c := cache.New(cache.WithTTU(10 * time.Millisecond))
+		for j := 0; j < 10; j++ {
+			c.Add(j, j)
+		}
+		p.Register(c, time.Duration(i+1)*5*time.Millisecond)
+		cs = append(cs, c)
+	}
+
+	// the last one won't be purged anymore
+	p.Unregister(cs[2])
+
+	deadline := time.Now().Add(time.Second)
+	for cs[0].Len() > 0 || cs[1].Len() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("got len() %d and %d, want 0", cs[0].Len(), cs[1].Len())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if cs[2].Len() != 10 {
+		t.Errorf("unregistered cache was purged: got len() %d, want 10", cs[2].Len())
+	}
+
+	p.Stop()
+	p.Stop() // must be safe
+}
+
+func TestPurgeScheduler_nonPositiveFreq(t *testing.T) {
+	p := cache.NewPurgeScheduler()
+	defer p.Stop()
+
+	for _, freq := range []time.Duration{0, -time.Second} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("no panic for a frequency of %v", freq)
+				}
+			}()
+			p.Register(cache.New(), freq)
+		}()
+	}
+
+	// the scheduler must still be usable
+	c := cache.New()
+	p.Register(c, time.Hour)
+	p.Unregister(c)
+}
@@ -1,8 +1,8 @@
 package cache
 
 import (
-	"container/list"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,116 +16,900 @@ import (
 // }
 
 type shard struct {
+	// counters are kept first so they're 64-bit aligned for atomic access
+	hits        uint64 // number of lookups that found a live entry
+	misses      uint64 // number of lookups that didn't
+	evictions   uint64 // number of entries removed to make room
+	expirations uint64 // number of expired entries purged
+	contended   uint64 // number of times the lock was found held, see WithContentionTracking
+
 	sync.Mutex
-	l   *list.List                    // the element list
-	idx map[interface{}]*list.Element // the list index
-	c   *Cache                        // reference to the parent cache
+	l     *entryList                  // the element list
+	prot  *entryList                  // the protected segment, see WithProtectHot
+	idx   map[interface{}]*cacheEntry // the index of both lists
+	calls map[interface{}]*call       // loads in flight, by key
+	busy  map[interface{}]struct{}    // keys being refreshed, see GetWithRefresh
+	locks map[interface{}]*keyLock    // keys locked or waited for, see LockEntry
+	c     *Cache                      // reference to the parent cache
+	i     int                         // the index of the shard in the cache
+
+	pending []func() // removal callbacks to run once unlocked, see AddWithCallback
+	full    bool     // whether the shard is evicting to stay within capacity
+	bytes   int64    // the total size of the entries, see WithMaxBytes
+	exp     expHeap  // the entries that can expire, by expiration
 }
 
-func newShard(c *Cache) *shard {
+func newShard(c *Cache, i int) *shard {
 	return &shard{
-		c:   c,
-		idx: make(map[interface{}]*list.Element),
-		l:   list.New(),
+		c:     c,
+		i:     i,
+		idx:   make(map[interface{}]*cacheEntry),
+		calls: make(map[interface{}]*call),
+		busy:  make(map[interface{}]struct{}),
+		locks: make(map[interface{}]*keyLock),
+		l:     newEntryList(),
+		prot:  newEntryList(),
+	}
+}
+
+// Lock locks the shard. When contention tracking is enabled, acquisitions that
+// find the shard already locked are counted.
+func (s *shard) Lock() {
+	if !s.c.trackContention {
+		s.Mutex.Lock()
+		return
+	}
+	if s.Mutex.TryLock() {
+		return
+	}
+	atomic.AddUint64(&s.contended, 1)
+	s.Mutex.Lock()
+}
+
+// tryLockFor tries to lock the shard for up to maxWait, and returns whether it
+// did. While the shard is locked by someone else, it polls the lock at
+// increasing intervals, starting at a microsecond.
+func (s *shard) tryLockFor(maxWait time.Duration) bool {
+	if s.Mutex.TryLock() {
+		return true
+	}
+	if s.c.trackContention {
+		atomic.AddUint64(&s.contended, 1)
+	}
+
+	deadline := time.Now().Add(maxWait)
+	for wait := time.Microsecond; ; wait *= 2 {
+		left := time.Until(deadline)
+		if left <= 0 {
+			return false
+		}
+		if wait > left {
+			wait = left
+		}
+		time.Sleep(wait)
+		if s.Mutex.TryLock() {
+			return true
+		}
+	}
+}
+
+// Unlock unlocks the shard, then runs the callbacks of the events that happened
+// while it was locked, such as entries being removed.
+func (s *shard) Unlock() {
+	callbacks := s.pending
+	s.pending = nil
+	s.Mutex.Unlock()
+	for _, fn := range callbacks {
+		fn()
 	}
 }
 
+// unlocks the shard, but adds the removal callbacks to callbacks rather than
+// running them. This is for callers that hold other locks, which must run them
+// once they have released everything.
+func (s *shard) unlockDeferring(callbacks *[]func()) {
+	*callbacks = append(*callbacks, s.pending...)
+	s.pending = nil
+	s.Mutex.Unlock()
+}
+
+// exchanges the entries of two shards. Caller must hold both mutexes.
+func (s *shard) swap(o *shard) {
+	s.l, o.l = o.l, s.l
+	s.prot, o.prot = o.prot, s.prot
+	s.idx, o.idx = o.idx, s.idx
+	s.bytes, o.bytes = o.bytes, s.bytes
+	s.exp, o.exp = o.exp, s.exp
+}
+
 func (s *shard) get(key interface{}) (interface{}, bool) {
 	s.Lock()
 	defer s.Unlock()
 
-	if el, found := s.idx[key]; found && !s.expired(el.Value.(*cacheEntry)) {
-		s.l.MoveToFront(el)
-		el.Value.(*cacheEntry).lu = time.Now()
-		return el.Value.(*cacheEntry).val, true
+	if val, ok := s.lookup(key); ok {
+		atomic.AddUint64(&s.hits, 1)
+		return val, true
 	}
 
+	atomic.AddUint64(&s.misses, 1)
 	return nil, false
 }
 
+// like get, but copies a []byte value into dst
+func (s *shard) getInto(key interface{}, dst []byte) (int, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	val, ok := s.lookup(key)
+	if !ok {
+		atomic.AddUint64(&s.misses, 1)
+		return 0, false
+	}
+	atomic.AddUint64(&s.hits, 1)
+
+	b, ok := val.([]byte)
+	if !ok {
+		return 0, false
+	}
+	return copy(dst, b), true
+}
+
+// looks up a live entry and marks it as used. Caller must hold the mutex.
+func (s *shard) lookup(key interface{}) (interface{}, bool) {
+	if ce, found := s.idx[key]; found && !s.expired(ce) {
+		s.use(ce)
+		return ce.val, true
+	}
+
+	return nil, false
+}
+
+// marks an entry as used, moving it to the front of its list. Entries that are
+// used often enough are moved to the protected segment, where they stay put, as
+// do entries used again within the cool-off period. Caller must hold the mutex.
+func (s *shard) use(ce *cacheEntry) {
+	ce.accessCount++
+	if ce.protected {
+		return
+	}
+
+	if d := s.c.coolOff; d > 0 {
+		now := time.Now()
+		if now.Sub(ce.lu) < d {
+			return // it was moved recently enough
+		}
+		ce.lu = now
+	} else {
+		ce.lu = time.Now()
+	}
+	if n := s.c.protectAt; n > 0 && ce.accessCount >= uint64(n) && s.protectedCap() > 0 {
+		s.protect(ce)
+		return
+	}
+	s.l.MoveToFront(ce)
+}
+
+// returns the max number of entries in the protected segment, or -1 if there's
+// no limit
+func (s *shard) protectedCap() int {
+	if s.c.cap == 0 {
+		return -1
+	}
+	return s.c.cap * 4 / 5
+}
+
+// moves an entry to the front of the protected segment, demoting the least
+// recently used protected entry back to the probation segment if that makes it
+// too large. Caller must hold the mutex.
+func (s *shard) protect(ce *cacheEntry) {
+	s.l.Remove(ce)
+	ce.protected = true
+	s.prot.PushFront(ce)
+
+	if max := s.protectedCap(); max >= 0 && s.prot.Len() > max {
+		d := s.prot.Remove(s.prot.Back())
+		d.protected = false
+		d.accessCount = 0
+		d.lu = time.Now()
+		s.l.PushFront(d)
+	}
+}
+
+// returns the list an entry belongs to
+func (s *shard) list(ce *cacheEntry) *entryList {
+	if ce.protected {
+		return s.prot
+	}
+	return s.l
+}
+
+// returns the least recently used element, or nil if the shard is empty.
+// Protected entries are only considered once the probation segment is empty,
+// and entries of a priority once there are none of a lower priority. Caller
+// must hold the mutex.
+func (s *shard) oldest() *cacheEntry {
+	if s.c.prioritized() {
+		return s.lowestPriority(true)
+	}
+	if ce := s.l.Back(); ce != nil {
+		return ce
+	}
+	return s.prot.Back()
+}
+
+// returns the element that would be evicted next to make room for a new one,
+// according to the eviction policy, or nil if the shard is empty. Caller must
+// hold the mutex.
+func (s *shard) victim() *cacheEntry {
+	if s.c.policy != PolicyEvictNewest {
+		return s.oldest()
+	}
+	if s.c.prioritized() {
+		return s.lowestPriority(false)
+	}
+	if ce := s.l.Front(); ce != nil {
+		return ce
+	}
+	return s.prot.Front()
+}
+
+// returns the number of entries. Caller must hold the mutex.
+func (s *shard) count() int {
+	return s.l.Len() + s.prot.Len()
+}
+
+// like get, but a live entry is only returned if valid, unless it's nil, and
+// the entry's own validator, if it has one, accept it. Otherwise it is removed
+// and the lookup is a miss. Since validators are called without the lock,
+// they're free to use the cache.
+func (s *shard) getValid(key interface{}, valid func(key, value interface{}) bool) (interface{}, bool) {
+	s.Lock()
+	ce, found := s.idx[key]
+	if !found || s.expired(ce) {
+		s.Unlock()
+		atomic.AddUint64(&s.misses, 1)
+		return nil, false
+	}
+	val, entryValid, age := ce.val, ce.valid, time.Since(ce.created)
+	s.Unlock()
+
+	ok, reason := true, ReasonRemoved
+	if valid != nil && !valid(key, val) {
+		ok = false
+	} else if entryValid != nil && !entryValid(val, age) {
+		ok, reason = false, ReasonExpired
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	// the entry may have been removed or replaced while we weren't looking
+	if s.idx[key] == ce {
+		if ok {
+			s.use(ce)
+		} else {
+			s.removeElement(ce, reason)
+		}
+	}
+	if !ok {
+		atomic.AddUint64(&s.misses, 1)
+		return nil, false
+	}
+	atomic.AddUint64(&s.hits, 1)
+	return val, true
+}
+
+// like lookup, but doesn't use the entry. Caller must hold the mutex.
+func (s *shard) peek(key interface{}) (interface{}, bool) {
+	if ce, found := s.idx[key]; found && !s.expired(ce) {
+		return ce.val, true
+	}
+
+	return nil, false
+}
+
+// returns the keys of the live entries, most recently used first
+func (s *shard) keys() []interface{} {
+	s.Lock()
+	defer s.Unlock()
+
+	keys := make([]interface{}, 0, s.count())
+	for _, l := range []*entryList{s.prot, s.l} {
+		for ce := l.Front(); ce != nil; ce = ce.Next() {
+			if !s.expired(ce) {
+				keys = append(keys, ce.key)
+			}
+		}
+	}
+	return keys
+}
+
+// like get, but also returns whether the value is an error, see AddError
+func (s *shard) getResult(key interface{}) (value interface{}, isErr, ok bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	ce, found := s.idx[key]
+	if !found || s.expired(ce) {
+		atomic.AddUint64(&s.misses, 1)
+		return nil, false, false
+	}
+	atomic.AddUint64(&s.hits, 1)
+	s.use(ce)
+	return ce.val, ce.isErr, true
+}
+
+// makes a live entry expire. It returns whether the entry was found and could
+// be expired.
+func (s *shard) expire(key interface{}) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	ce, found := s.idx[key]
+	if !found || s.expired(ce) {
+		return false
+	}
+	return s.expireEntry(ce)
+}
+
+// backdates an entry so that it's expired, unless it never expires. It returns
+// whether the entry expired. Caller must hold the mutex.
+func (s *shard) expireEntry(ce *cacheEntry) bool {
+	now := time.Now()
+	ttu := s.c.entryTTU(ce)
+	if ttu != 0 {
+		ce.lu = now.Add(-ttu - 1)
+	}
+	if s.c.fixedTTL != 0 {
+		ce.created = now.Add(-s.c.fixedTTL - 1)
+	}
+	if ttu == 0 && s.c.fixedTTL == 0 {
+		return false
+	}
+	s.reorder(ce)
+	s.scheduleExpiry(ce)
+	return true
+}
+
+// marks a live entry as used. It returns whether the entry was found.
+func (s *shard) touch(key interface{}) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	_, ok := s.lookup(key)
+	return ok
+}
+
+// like get, but also returns when the entry expires
+func (s *shard) getWithExpiration(key interface{}) (value interface{}, expiresAt time.Time, ok bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	ce, found := s.idx[key]
+	if !found || s.expired(ce) {
+		atomic.AddUint64(&s.misses, 1)
+		return nil, time.Time{}, false
+	}
+	atomic.AddUint64(&s.hits, 1)
+	s.use(ce)
+	return ce.val, s.expiresAt(ce), true
+}
+
+// appends the live entries to entries, from the least to the most recently
+// used, with the protected ones last
+func (s *shard) export(entries []Element) []Element {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, l := range []*entryList{s.l, s.prot} {
+		for ce := l.Back(); ce != nil; ce = ce.Prev() {
+			if !s.expired(ce) {
+				entries = append(entries, ce.element())
+			}
+		}
+	}
+	return entries
+}
+
+// adds an exported entry, see Import. If created isn't zero, it's when the
+// value was set, see LoadSnapshot.
+func (s *shard) restore(e Element, created time.Time) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.set(e.Key, e.Value)
+	if ce, found := s.idx[e.Key]; found {
+		ce.lu, ce.accessCount, ce.ttu = e.LastUsed, e.AccessCount, e.TTU
+		if !created.IsZero() {
+			ce.created = created
+		}
+		s.scheduleExpiry(ce)
+		s.reorder(ce)
+	}
+}
+
+// calls fn for each live entry, with the mutex held, until fn returns false.
+// Returns false if it was stopped.
+func (s *shard) rangeEntries(fn func(key, value interface{}) bool) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, l := range []*entryList{s.prot, s.l} {
+		for ce := l.Front(); ce != nil; ce = ce.Next() {
+			if !s.expired(ce) && !fn(ce.key, ce.val) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// like get, but an entry that expired and wasn't purged yet is returned as
+// stale rather than ignored. Stale entries are left untouched.
+func (s *shard) getStale(key interface{}) (value interface{}, stale, ok bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	ce, found := s.idx[key]
+	if !found {
+		atomic.AddUint64(&s.misses, 1)
+		return nil, false, false
+	}
+
+	if s.expired(ce) {
+		atomic.AddUint64(&s.misses, 1)
+		return ce.val, true, true
+	}
+
+	atomic.AddUint64(&s.hits, 1)
+	s.use(ce)
+	return ce.val, false, true
+}
+
+// backdates the last used time of all entries so that they're expired
+func (s *shard) invalidate(lu, created time.Time) {
+	s.Lock()
+	defer s.Unlock()
+
+	// every entry is looked at, since the lists aren't always ordered by last
+	// used time
+	for _, l := range []*entryList{s.l, s.prot} {
+		for ce := l.Front(); ce != nil; ce = ce.Next() {
+			if !lu.IsZero() && ce.lu.After(lu) {
+				ce.lu = lu
+			}
+			if !created.IsZero() && ce.created.After(created) {
+				ce.created = created
+			}
+		}
+	}
+	s.rescheduleAll()
+}
+
+// sets the last used time of an entry. It returns whether the key was found.
+func (s *shard) setLastUsed(key interface{}, t time.Time) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	ce, found := s.idx[key]
+	if !found {
+		return false
+	}
+	ce.lu = t
+	s.reorder(ce)
+	s.scheduleExpiry(ce)
+	return true
+}
+
+// moves an element within its list so that the list remains ordered from the
+// most to the least recently used entry. Caller must hold the mutex.
+func (s *shard) reorder(ce *cacheEntry) {
+	l := s.list(ce)
+
+	// move it back past any more recently used entries...
+	mark := ce
+	for n := ce.Next(); n != nil && ce.usedBefore(n); n = n.Next() {
+		mark = n
+	}
+	if mark != ce {
+		l.MoveAfter(ce, mark)
+		return
+	}
+
+	// ...or forward past any less recently used ones
+	for p := ce.Prev(); p != nil && p.usedBefore(ce); p = p.Prev() {
+		mark = p
+	}
+	if mark != ce {
+		l.MoveBefore(ce, mark)
+	}
+}
+
+// returns the entry at position rank, counting from the protected segment's
+// most recently used entry
+func (s *shard) entryAtRank(rank int) (Element, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, l := range []*entryList{s.prot, s.l} {
+		if rank >= l.Len() {
+			rank -= l.Len()
+			continue
+		}
+		ce := l.Front()
+		for ; rank > 0; rank-- {
+			ce = ce.Next()
+		}
+		return ce.element(), true
+	}
+	return Element{}, false
+}
+
+// replaces the values of the live entries matching pred, see UpdateFunc
+func (s *shard) updateFunc(pred func(key, value interface{}) bool, update func(value interface{}) interface{}) int {
+	s.Lock()
+	defer s.Unlock()
+
+	n := 0
+	for _, ce := range s.idx {
+		if !s.expired(ce) && pred(ce.key, ce.val) {
+			ce.val = update(ce.val)
+			ce.reduced, ce.isErr = false, false
+			s.recost(ce)
+			n++
+		}
+	}
+	s.evictOverBytes()
+	return n
+}
+
+// replaces the value of key, if it's live, with update's result, see
+// GetAndUpdate
+func (s *shard) getAndUpdate(key interface{}, update func(value interface{}) interface{}) (interface{}, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	ce, found := s.idx[key]
+	if !found || s.expired(ce) {
+		atomic.AddUint64(&s.misses, 1)
+		return nil, false
+	}
+	atomic.AddUint64(&s.hits, 1)
+
+	s.use(ce)
+	s.list(ce).MoveToFront(ce)
+	ce.val = update(ce.val)
+	ce.reduced, ce.isErr = false, false
+	ce.lu = time.Now()
+	ce.created = ce.lu
+	if s.c.coster != nil {
+		s.resize(ce, s.c.coster(key, ce.val))
+	}
+	return ce.val, true
+}
+
+// returns the entry of key, if it's live, without using it
+func (s *shard) entry(key interface{}) (Element, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	if ce, found := s.idx[key]; found && !s.expired(ce) {
+		return ce.element(), true
+	}
+	return Element{}, false
+}
+
+// reports whether key is the least recently used entry of the shard
+func (s *shard) isBack(key interface{}) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	ce, found := s.idx[key]
+	return found && ce == s.victim()
+}
+
+// returns the number of entries in the shard
+func (s *shard) len() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.count()
+}
+
+// returns the last used times of the least and most recently used entries
+func (s *shard) lastUsed() (oldest, newest time.Time, ok bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, l := range []*entryList{s.l, s.prot} {
+		if l.Len() == 0 {
+			continue
+		}
+		back, front := l.Back().lu, l.Front().lu
+		if !ok || back.Before(oldest) {
+			oldest = back
+		}
+		if !ok || front.After(newest) {
+			newest = front
+		}
+		ok = true
+	}
+	return oldest, newest, ok
+}
+
 // helper function to check if a cacheEntry is expired. Caller should hold the
 // mutex for reading
 func (s *shard) expired(ce *cacheEntry) bool {
-	if s.c.ttu == time.Duration(0) {
+	if !s.c.hasExpiry() {
 		return false // no expiration
 	}
-	return ce.lu.Add(s.c.ttu).Before(time.Now())
+	t := s.expiresAt(ce)
+	return !t.IsZero() && t.Before(time.Now())
+}
+
+// returns when an entry expires, unless it's used again, or the zero time if
+// it never does. Caller should hold the mutex for reading
+func (s *shard) expiresAt(ce *cacheEntry) time.Time {
+	var t time.Time
+	if ttu := s.c.entryTTU(ce); ttu != 0 {
+		t = ce.lu.Add(ttu)
+	}
+	if s.c.fixedTTL != 0 {
+		if f := ce.created.Add(s.c.fixedTTL); t.IsZero() || f.Before(t) {
+			t = f
+		}
+	}
+	return t
 }
 
-// sets the value of a key. If the key was found, the element is returned.
-func (s *shard) add(key, val interface{}) *list.Element {
+// adds or updates an entry, returning how many entries were evicted to make
+// room for it
+func (s *shard) add(key, val interface{}) (evicted int) {
 	s.Lock()
 	defer s.Unlock()
+	return s.set(key, val)
+}
+
+// like add, but also returns the value that was replaced, if any
+func (s *shard) addReturningOld(key, val interface{}) (old interface{}, existed bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	if ce, ok := s.idx[key]; ok {
+		old, existed = ce.val, true
+	}
+	s.set(key, val)
+	return old, existed
+}
+
+// like add, but the caller must hold the mutex
+func (s *shard) set(key, val interface{}) (evicted int) {
+	if s.c.disabled {
+		return 0
+	}
 
 	// check if already in the cache?
-	if el, ok := s.idx[key]; ok {
-		s.l.MoveToFront(el)
-		el.Value.(*cacheEntry).val = val
-		el.Value.(*cacheEntry).lu = time.Now()
-		return el
+	if ce, ok := s.idx[key]; ok {
+		if s.c.equal != nil && s.c.equal(ce.val, val) {
+			return 0 // no-op update
+		}
+		s.list(ce).MoveToFront(ce)
+		if fn := s.c.onEvict; fn != nil {
+			old := ce.val
+			s.pending = append(s.pending, func() { fn(key, old, ReasonReplaced) })
+		}
+		ce.val = val
+		ce.reduced, ce.isErr = false, false
+		ce.lu = time.Now()
+		ce.created = ce.lu
+		if s.c.coster != nil {
+			return s.resize(ce, s.c.coster(key, val))
+		}
+		return 0
 	}
 
-	el := s.l.PushFront(&cacheEntry{key, val, time.Now()})
-	s.idx[key] = el
+	// see if we're going over capacity. The victim is picked before the new
+	// entry is added so that it's never the new entry itself.
+	var victim *cacheEntry
+	if s.c.cap > 0 && !s.c.manualEviction && s.count() >= s.c.cap {
+		victim = s.victim()
+	}
+	if s.c.totalCap > 0 {
+		n := atomic.AddInt64(&s.c.entries, 1)
+		if n > int64(s.c.totalCap) && !s.c.manualEviction {
+			if victim == nil {
+				victim = s.victim()
+			}
+			if victim == nil {
+				// the shard is empty, so the room must be made elsewhere
+				s.pending = append(s.pending, func() { s.c.evictOverTotal() })
+			}
+		}
+	}
 
-	// see if we're over capacity
-	if s.c.cap > 0 && s.l.Len() > s.c.cap {
-		s.removeOldest()
+	now := time.Now()
+	seq := atomic.AddUint64(&s.c.seq, 1)
+	ce := s.l.PushFront(&cacheEntry{key: key, val: val, lu: now, created: now, seq: seq, expIdx: -1})
+	s.idx[key] = ce
+	s.scheduleExpiry(ce)
+
+	if victim != nil {
+		s.evict(victim)
+		s.overflowed()
+		evicted++
+	}
+	if s.c.coster != nil {
+		evicted += s.resize(ce, s.c.coster(key, val))
 	}
-	return el
+	return evicted
 }
 
-// removes entries that are expired
-func (s *shard) purge() int {
+// removes entries until the shard is within capacity, returning how many were
+// removed
+func (s *shard) evictOverflow() int {
 	s.Lock()
 	defer s.Unlock()
 
-	if s.l.Len() == 0 {
+	if s.c.cap <= 0 {
 		return 0
 	}
-	var expired int
-	if s.c.ttu != time.Duration(0) {
-		for {
-			el := s.l.Back()
-			if el == nil {
-				break // no more items
-			}
-			ce := el.Value.(*cacheEntry)
-			if !s.expired(ce) {
-				break // no more expired items
-			}
-			s.removeElement(el)
-			expired++
-		}
+	n := 0
+	for s.count() > s.c.cap {
+		s.evict(s.victim())
+		n++
+	}
+	if n > 0 {
+		s.overflowed()
+	}
+	return n
+}
+
+// removes entries that are expired, examining at most budget entries, and
+// returns how many were removed and examined. If budget is 0 or less, there is
+// no limit.
+func (s *shard) purge(budget int) (expired, examined int) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.count() == 0 {
+		return 0, 0
+	}
+	if s.c.hasExpiry() {
+		expired, examined = s.purgeExpired(time.Now(), budget)
 	}
-	return expired
+	atomic.AddUint64(&s.expirations, uint64(expired))
+	return expired, examined
 }
 
 func (s *shard) remove(key interface{}) interface{} {
 	s.Lock()
 	defer s.Unlock()
 
-	if el, found := s.idx[key]; found {
-		_, value := s.removeElement(el)
+	if ce, found := s.idx[key]; found {
+		_, value := s.removeElement(ce, ReasonRemoved)
 		return value
 	}
 
 	return nil
 }
 
-// removes the oldest element in the cache. Caller must hold the mutex for writing
+// removes all entries, see Clear
+func (s *shard) clear() {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, l := range []*entryList{s.l, s.prot} {
+		for ce := l.Back(); ce != nil; ce = l.Back() {
+			s.removeElement(ce, ReasonCleared)
+		}
+	}
+	// a fresh map releases the memory of the old one, which never shrinks
+	s.idx = make(map[interface{}]*cacheEntry)
+}
+
+// rebuilds the maps of the shard at their current size, see Compact
+func (s *shard) compact() {
+	s.Lock()
+	defer s.Unlock()
+
+	idx := make(map[interface{}]*cacheEntry, len(s.idx))
+	for key, ce := range s.idx {
+		idx[key] = ce
+	}
+	s.idx = idx
+	calls := make(map[interface{}]*call, len(s.calls))
+	for key, cl := range s.calls {
+		calls[key] = cl
+	}
+	s.calls = calls
+	busy := make(map[interface{}]struct{}, len(s.busy))
+	for key := range s.busy {
+		busy[key] = struct{}{}
+	}
+	s.busy = busy
+	locks := make(map[interface{}]*keyLock, len(s.locks))
+	for key, kl := range s.locks {
+		locks[key] = kl
+	}
+	s.locks = locks
+}
+
+// removes all entries, appending the ones that hadn't expired to entries, from
+// the least to the most recently used, with the protected ones last. Caller
+// must hold the mutex for writing.
+func (s *shard) removeAll(entries []Element) []Element {
+	for _, l := range []*entryList{s.l, s.prot} {
+		for ce := l.Back(); ce != nil; ce = l.Back() {
+			if s.expired(ce) {
+				s.removeElement(ce, ReasonExpired)
+				continue
+			}
+			entries = append(entries, ce.element())
+			s.removeElement(ce, ReasonRemoved)
+		}
+	}
+	return entries
+}
+
+// notes that the shard evicted entries to stay within its capacity, calling
+// the capacity observer if it wasn't already doing so. Caller must hold the
+// mutex for writing
+func (s *shard) overflowed() {
+	if s.full {
+		return
+	}
+	s.full = true
+	if fn := s.c.capObserver; fn != nil {
+		i := s.i
+		s.pending = append(s.pending, func() { fn(i) })
+	}
+}
+
+// removes the oldest element in the cache, counting it as an eviction. Caller
+// must hold the mutex for writing
 func (s *shard) removeOldest() (key, value interface{}) {
-	el := s.l.Back()
-	if el == nil {
+	ce := s.oldest()
+	if ce == nil {
 		return
 	}
 
-	return s.removeElement(el)
+	return s.evict(ce)
 }
 
-func (s *shard) removeElement(el *list.Element) (key, value interface{}) {
-	s.l.Remove(el)
-	e := el.Value.(*cacheEntry)
-	delete(s.idx, e.key)
-	return e.key, e.val
+// removes an element to make room for others, counting it as an eviction.
+// Caller must hold the mutex for writing
+func (s *shard) evict(ce *cacheEntry) (key, value interface{}) {
+	atomic.AddUint64(&s.evictions, 1)
+	if el := s.c.evictLog; el != nil {
+		key := ce.key
+		s.pending = append(s.pending, func() { el.log(key) })
+	}
+	return s.removeElement(ce, ReasonCapacity)
+}
+
+// removes an element from the shard, recording why in the eviction history.
+// Caller must hold the mutex for writing
+func (s *shard) removeElement(ce *cacheEntry, reason EvictReason) (key, value interface{}) {
+	s.list(ce).Remove(ce)
+	delete(s.idx, ce.key)
+	s.bytes -= ce.size
+	s.unscheduleExpiry(ce)
+	if s.c.totalCap > 0 {
+		atomic.AddInt64(&s.c.entries, -1)
+	}
+	if s.full && s.count() < s.c.cap {
+		s.full = false
+	}
+	s.c.forget(ce.key)
+	if reason == ReasonExpired && atomic.LoadInt32(&s.c.hasDeps) != 0 {
+		// dependents are in other shards, so they're removed once unlocked
+		key := ce.key
+		s.pending = append(s.pending, func() { s.c.removeDependents(key) })
+	}
+	s.c.history.record(ce.key, reason)
+	if fn := ce.onRemove; fn != nil {
+		s.pending = append(s.pending, func() { fn(ce.key, ce.val) })
+	}
+	if fn := s.c.onEvict; fn != nil {
+		s.pending = append(s.pending, func() { fn(ce.key, ce.val, reason) })
+	}
+	return ce.key, ce.val
 }
@@ -0,0 +1,183 @@
+package cache
+
+// WithMaxBytes configures the cache to hold at most n bytes worth of entries,
+// as sized by the coster, see WithCoster, or given to AddWithSize. The budget
+// is divided across shards, rounding up, and each shard evicts entries, as it
+// would to stay within its capacity, until the entries it holds fit in its
+// share. An entry is never evicted to make room for itself, so a single entry
+// larger than the share of its shard is kept, alone. Entries of unknown size
+// count as 0 bytes. The budget applies along with the capacity, if any. n must
+// be larger than 0.
+func WithMaxBytes(n int64) Option {
+	return optionFunc(func(c *Cache) {
+		if n < 1 {
+			panic("the max number of bytes must be larger than 0")
+		}
+		c.maxBytes = n
+	})
+}
+
+// WithCoster configures the cache to size entries with cost, which should
+// return, in bytes, about how much memory the entry holds, see WithMaxBytes.
+// It's called every time a value is added, with the lock of its shard held,
+// so it must be fast and must not use the cache.
+func WithCoster(cost func(key, value interface{}) int64) Option {
+	return optionFunc(func(c *Cache) {
+		c.coster = cost
+	})
+}
+
+// CostAdmission says what TryAddWithCost does with entries that don't fit in
+// the byte budget, see WithCostAdmission.
+type CostAdmission int
+
+const (
+	// AdmitEvict evicts other entries to make room for the new one. This is
+	// the default.
+	AdmitEvict CostAdmission = iota
+
+	// AdmitReject rejects the new entry if making room for it would evict too
+	// much of the cache.
+	AdmitReject
+)
+
+// WithCostAdmission configures how TryAddWithCost admits entries that don't fit
+// in the byte budget of their shard, see WithMaxBytes. Under AdmitReject, an
+// entry is rejected if more than fraction of its shard's budget would have to
+// be evicted to make room for it, so that a single large value can't flush
+// many smaller ones. An entry going into an empty shard evicts nothing, so
+// it's always admitted. fraction must be between 0 and 1, and is ignored under
+// AdmitEvict. Other ways of adding entries always evict to make room.
+func WithCostAdmission(admission CostAdmission, fraction float64) Option {
+	return optionFunc(func(c *Cache) {
+		if fraction < 0 || fraction > 1 {
+			panic("the fraction must be between 0 and 1")
+		}
+		c.admission = admission
+		c.admitFrac = fraction
+	})
+}
+
+// TryAddWithCost is like AddWithSize, but the entry is only added if admitted,
+// see WithCostAdmission. It returns whether the entry was added. A rejected
+// entry leaves the cache untouched, including any value already held for the
+// key.
+func (c *Cache) TryAddWithCost(key, val interface{}, cost int64) bool {
+	c.init()
+	s := c.shard(key)
+	s.Lock()
+	defer s.Unlock()
+
+	if c.disabled || !s.admits(key, cost) {
+		return false
+	}
+	s.set(key, val)
+	if ce, found := s.idx[key]; found {
+		s.resize(ce, cost)
+	}
+	return true
+}
+
+// AddWithSize is like Add, but the entry is size bytes large, whatever the
+// coster, see WithCoster, says. Adding the key again with Add has the coster
+// size the entry, or keeps its size if there's no coster; adding it with
+// AddWithSize replaces both the value and the size.
+func (c *Cache) AddWithSize(key, val interface{}, size int64) {
+	c.init()
+	s := c.shard(key)
+	s.Lock()
+	defer s.Unlock()
+
+	s.set(key, val)
+	if ce, found := s.idx[key]; found {
+		s.resize(ce, size)
+	}
+}
+
+// Bytes returns the total size of the entries currently held in the cache, see
+// WithMaxBytes
+func (c *Cache) Bytes() int64 {
+	c.init()
+
+	var n int64
+	for _, s := range c.allShards() {
+		s.Lock()
+		n += s.bytes
+		s.Unlock()
+	}
+	return n
+}
+
+// shardBytes returns the byte budget of each shard, if the cache has one
+func (c *Cache) shardBytes() int64 {
+	n := int64(c.nshards)
+	return (c.maxBytes + n - 1) / n
+}
+
+// sets the size of an entry, which must be at the front of its list, as it is
+// once it's set, and evicts other entries until the shard is within its byte
+// budget. Returns how many entries were evicted. Caller must hold the mutex.
+func (s *shard) resize(ce *cacheEntry, size int64) (evicted int) {
+	s.bytes += size - ce.size
+	ce.size = size
+	if s.c.maxBytes <= 0 || s.c.manualEviction || s.bytes <= s.c.shardBytes() {
+		return 0
+	}
+
+	// the entry is set aside while making room, so that it's never picked
+	l := s.list(ce)
+	l.Remove(ce)
+	evicted = s.evictOverBytes()
+	l.PushFront(ce)
+	return evicted
+}
+
+// reports whether an entry of the given cost is admitted for key, see
+// WithCostAdmission. Caller must hold the mutex.
+func (s *shard) admits(key interface{}, cost int64) bool {
+	if s.c.admission != AdmitReject || s.c.maxBytes <= 0 || s.c.manualEviction {
+		return true
+	}
+
+	// the entry replaces any value already held for the key, and evicting
+	// can't free more than what the other entries hold
+	others := s.bytes
+	if ce, found := s.idx[key]; found {
+		others -= ce.size
+	}
+	budget := s.c.shardBytes()
+	evict := others + cost - budget
+	if evict > others {
+		evict = others
+	}
+	return float64(evict) <= s.c.admitFrac*float64(budget)
+}
+
+// has the coster, if there's one, size an entry again after its key or value
+// changed in place, without evicting anything. Callers follow up with
+// evictOverBytes once they're done changing entries. Caller must hold the
+// mutex.
+func (s *shard) recost(ce *cacheEntry) {
+	if s.c.coster == nil {
+		return
+	}
+	size := s.c.coster(ce.key, ce.val)
+	s.bytes += size - ce.size
+	ce.size = size
+}
+
+// evicts entries, as it would to stay within capacity, until the shard is
+// within its byte budget, and returns how many were evicted. Caller must hold
+// the mutex.
+func (s *shard) evictOverBytes() (evicted int) {
+	if s.c.maxBytes <= 0 || s.c.manualEviction {
+		return 0
+	}
+	for budget := s.c.shardBytes(); s.bytes > budget && s.count() > 0; evicted++ {
+		s.evict(s.victim())
+	}
+	if evicted > 0 {
+		s.overflowed()
+	}
+	return evicted
+}
@@ -0,0 +1,180 @@
+package cache_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/robteix/cache"
+)
+
+func TestWithMaxBytes(t *testing.T) {
+	c := cache.New(cache.WithMaxBytes(100), cache.WithCoster(func(key, value interface{}) int64 {
+		return int64(len(value.(string)))
+	}))
+	c.Add("a", string(make([]byte, 10)))
+	c.Add("b", string(make([]byte, 50)))
+	c.Add("c", string(make([]byte, 30)))
+	if c.Len() != 3 || c.Bytes() != 90 {
+		t.Fatalf("got %d entries and %d bytes, want 3 and 90", c.Len(), c.Bytes())
+	}
+
+	c.Add("d", string(make([]byte, 40))) // evicts a and b
+	if c.Contains("a") || c.Contains("b") || !c.Contains("c") || c.Bytes() != 70 {
+		t.Errorf("got keys %v and %d bytes, want [d c] and 70", c.Keys(), c.Bytes())
+	}
+
+	c.Add("c", string(make([]byte, 90))) // grows, evicting d
+	if c.Len() != 1 || c.Bytes() != 90 {
+		t.Errorf("got keys %v and %d bytes, want [c] and 90", c.Keys(), c.Bytes())
+	}
+
+	c.Add("e", string(make([]byte, 200))) // larger than the budget, kept alone
+	if c.Len() != 1 || !c.Contains("e") || c.Bytes() != 200 {
+		t.Errorf("got keys %v and %d bytes, want [e] and 200", c.Keys(), c.Bytes())
+	}
+
+	c.Remove("e")
+	if c.Bytes() != 0 {
+		t.Errorf("got %d bytes in an empty cache", c.Bytes())
+	}
+	if err := c.CheckInvariants(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCache_AddWithSize(t *testing.T) {
+	c := cache.New(cache.WithShards(2), cache.WithMaxBytes(200))
+	for i := 0; i < 100; i++ {
+		c.AddWithSize(i, i, int64(i%7+1))
+		for shard := 0; shard < 2; shard++ {
+			var bytes int64
+			for _, key := range c.Keys() {
+				if c.ShardIndex(key) == shard {
+					bytes += int64(key.(int)%7 + 1)
+				}
+			}
+			if bytes > 100 {
+				t.Fatalf("shard %d holds %d bytes, want at most 100", shard, bytes)
+			}
+		}
+	}
+	if err := c.CheckInvariants(); err != nil {
+		t.Error(err)
+	}
+
+	c = cache.New()
+	c.AddWithSize(1, "a", 10)
+	c.Add(1, "b") // keeps the size
+	c.AddWithSize(2, "c", 5)
+	c.AddWithSize(2, "d", 7) // replaces the size
+	if got := c.Bytes(); got != 17 {
+		t.Errorf("got %d bytes, want 17", got)
+	}
+}
+
+func TestWithMaxBytes_updates(t *testing.T) {
+	coster := cache.WithCoster(func(key, value interface{}) int64 {
+		return int64(len(value.(string)))
+	})
+	bytes := func(n int) string { return string(make([]byte, n)) }
+
+	c := cache.New(cache.WithMaxBytes(100), coster)
+	c.Add("a", bytes(10))
+	c.Add("b", bytes(40))
+	c.GetAndUpdate("a", func(interface{}) interface{} { return bytes(40) })
+	if got := c.Bytes(); got != 80 {
+		t.Errorf("got %d bytes after GetAndUpdate, want 80", got)
+	}
+	c.GetAndUpdate("a", func(interface{}) interface{} { return bytes(70) }) // evicts b
+	if c.Len() != 1 || !c.Contains("a") || c.Bytes() != 70 {
+		t.Errorf("got keys %v and %d bytes after GetAndUpdate, want [a] and 70", c.Keys(), c.Bytes())
+	}
+
+	c.Add("b", bytes(10))
+	c.UpdateFunc(func(key, _ interface{}) bool { return key == "b" }, func(interface{}) interface{} {
+		return bytes(60)
+	}) // evicts a, which is less recently used
+	if c.Len() != 1 || !c.Contains("b") || c.Bytes() != 60 {
+		t.Errorf("got keys %v and %d bytes after UpdateFunc, want [b] and 60", c.Keys(), c.Bytes())
+	}
+
+	c.AddReducible("c", bytes(40), func(interface{}) interface{} { return bytes(1) })
+	if n := c.Reduce(1); n != 1 || c.Bytes() != 61 {
+		t.Errorf("got %d reduced and %d bytes after Reduce, want 1 and 61", n, c.Bytes())
+	}
+	if err := c.CheckInvariants(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWithMaxBytes_rename(t *testing.T) {
+	c := cache.New(cache.WithShards(2), cache.WithMaxBytes(20), cache.WithCoster(func(key, value interface{}) int64 {
+		return int64(len(value.(string)))
+	}))
+
+	// find keys in both shards
+	var from, to []string
+	for i := 0; len(from) < 2 || len(to) < 2; i++ {
+		k := fmt.Sprint("key", i)
+		if c.ShardIndex(k) == 0 {
+			from = append(from, k)
+		} else {
+			to = append(to, k)
+		}
+	}
+
+	c.Add(to[0], "12345678")
+	c.Add(from[0], "12345678")
+	c.Rename(from[0], to[1]) // takes the shard of to[0] over its 10 bytes, evicting it
+	if c.Contains(to[0]) || !c.Contains(to[1]) || c.Bytes() != 8 {
+		t.Errorf("got keys %v and %d bytes, want [%s] and 8", c.Keys(), c.Bytes(), to[1])
+	}
+	if err := c.CheckInvariants(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCache_TryAddWithCost(t *testing.T) {
+	full := func(opts ...cache.Option) *cache.Cache {
+		c := cache.New(append(opts, cache.WithMaxBytes(100))...)
+		for i := 0; i < 10; i++ {
+			c.AddWithSize(i, i, 10)
+		}
+		return c
+	}
+	reject := cache.WithCostAdmission(cache.AdmitReject, 0.5)
+
+	tests := []struct {
+		name    string
+		c       *cache.Cache
+		key     interface{}
+		cost    int64
+		added   bool
+		entries int
+		bytes   int64
+	}{
+		{"evicts half", full(reject), "big", 50, true, 6, 100},
+		{"evicts more than half", full(reject), "big", 51, false, 10, 100},
+		{"evicts most", full(reject), "big", 90, false, 10, 100},
+		{"larger than the budget", full(reject), "big", 200, false, 10, 100},
+		{"replaces", full(reject), 0, 60, true, 5, 100},
+		{"evict admission", full(), "big", 90, true, 2, 100},
+		{"empty shard", cache.New(cache.WithMaxBytes(100), reject), "big", 200, true, 1, 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if added := tt.c.TryAddWithCost(tt.key, "v", tt.cost); added != tt.added {
+				t.Errorf("got %v, want %v", added, tt.added)
+			}
+			if v, _ := tt.c.Get(tt.key); (v == "v") != tt.added {
+				t.Errorf("got value %v for %v, want the new value: %v", v, tt.key, tt.added)
+			}
+			if tt.c.Len() != tt.entries || tt.c.Bytes() != tt.bytes {
+				t.Errorf("got %d entries and %d bytes, want %d and %d", tt.c.Len(), tt.c.Bytes(), tt.entries, tt.bytes)
+			}
+			if err := tt.c.CheckInvariants(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package cache
+
+import (
+	"encoding/gob"
+	"io"
+	"time"
+)
+
+// snapshotEntry is the gob representation of an entry, see Snapshot
+type snapshotEntry struct {
+	Key, Value  interface{}
+	LastUsed    time.Time
+	Created     time.Time // when the value was set, see WithFixedTTL
+	AccessCount uint64
+	TTU         time.Duration // the entry's own TTU, see AddWithTTU, or 0
+	ExpiresAt   time.Time     // when the entry expires, or zero if it never does
+}
+
+// Snapshot writes the entries of the cache that haven't expired to w, gob
+// encoded, so that they can be loaded into another cache with LoadSnapshot,
+// for instance to keep a cache warm across restarts of the program. Along
+// with their keys and values, entries keep their last used times, the times
+// their values were set, their access counts and their own TTUs, so that they
+// expire when they would have had they stayed in the cache.
+//
+// Keys and values must be gob encodable, and types other than the basic ones
+// must be registered with gob.Register, both when writing and when loading
+// the snapshot. As with Export, shards are locked one at a time, and taking a
+// snapshot doesn't count as a use of the entries.
+func (c *Cache) Snapshot(w io.Writer) error {
+	c.init()
+
+	var entries []snapshotEntry
+	for _, s := range c.allShards() {
+		entries = s.snapshot(entries)
+	}
+	return gob.NewEncoder(w).Encode(entries)
+}
+
+// LoadSnapshot adds the entries written by Snapshot to the cache, as Import
+// does, except that fixed TTLs, see WithFixedTTL, keep running from when the
+// values were set rather than starting over. Entries that expired since the
+// snapshot was taken are left out. Nothing is added if the snapshot can't be
+// decoded.
+func (c *Cache) LoadSnapshot(r io.Reader) error {
+	c.init()
+
+	var entries []snapshotEntry
+	if err := gob.NewDecoder(r).Decode(&entries); err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, e := range entries {
+		if !e.ExpiresAt.IsZero() && e.ExpiresAt.Before(now) {
+			continue
+		}
+		if e.TTU > 0 {
+			c.noteEntryTTU(e.TTU)
+		}
+		el := Element{Key: e.Key, Value: e.Value, LastUsed: e.LastUsed, AccessCount: e.AccessCount, TTU: e.TTU}
+		c.shard(e.Key).restore(el, e.Created)
+	}
+	return nil
+}
+
+// appends the live entries to entries, in the order of export
+func (s *shard) snapshot(entries []snapshotEntry) []snapshotEntry {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, l := range []*entryList{s.l, s.prot} {
+		for ce := l.Back(); ce != nil; ce = ce.Prev() {
+			if s.expired(ce) {
+				continue
+			}
+			entries = append(entries, snapshotEntry{
+				Key:         ce.key,
+				Value:       ce.val,
+				LastUsed:    ce.lu,
+				Created:     ce.created,
+				AccessCount: ce.accessCount,
+				TTU:         ce.ttu,
+				ExpiresAt:   s.expiresAt(ce),
+			})
+		}
+	}
+	return entries
+}
@@ -0,0 +1,72 @@
+package cache_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/robteix/cache"
+)
+
+func TestCache_Snapshot(t *testing.T) {
+	src := cache.New(cache.WithTTU(time.Hour), cache.WithShards(4))
+	for i := 0; i < 10; i++ {
+		src.Add(i, i*10)
+	}
+	src.AddWithTTU("short", "s", time.Minute)
+	src.AddWithTTU("gone", "g", 20*time.Millisecond)
+	want := make(map[interface{}]cache.Element)
+	for _, e := range src.Export() {
+		want[e.Key] = e
+	}
+
+	var buf bytes.Buffer
+	if err := src.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(30 * time.Millisecond) // gone expires in the meantime
+
+	dst := cache.New(cache.WithTTU(time.Hour), cache.WithShards(4))
+	if err := dst.LoadSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	got := dst.Export()
+	if len(got) != 11 || dst.Contains("gone") {
+		t.Errorf("got keys %v, want all but gone", dst.Keys())
+	}
+	// entries expire when they would have in src, since they keep their last
+	// used times and TTUs
+	for _, e := range got {
+		w := want[e.Key]
+		if e.Value != w.Value || !e.LastUsed.Equal(w.LastUsed) || e.TTU != w.TTU {
+			t.Errorf("got %+v, want %+v", e, w)
+		}
+	}
+	if err := dst.CheckInvariants(); err != nil {
+		t.Error(err)
+	}
+
+	if err := dst.LoadSnapshot(strings.NewReader("not a snapshot")); err == nil {
+		t.Error("loaded an invalid snapshot")
+	}
+}
+
+func TestCache_SnapshotFixedTTL(t *testing.T) {
+	src := cache.New(cache.WithFixedTTL(40 * time.Millisecond))
+	src.Add("a", 1)
+	var buf bytes.Buffer
+	if err := src.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	dst := cache.New(cache.WithFixedTTL(40 * time.Millisecond))
+	if err := dst.LoadSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if dst.Contains("a") {
+		t.Error("the fixed TTL started over")
+	}
+}
@@ -0,0 +1,225 @@
+package cache
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Stats holds counters describing the activity of a Cache
+type Stats struct {
+	Hits        uint64 // number of lookups that found a live entry
+	Misses      uint64 // number of lookups that found no entry or an expired one
+	Evictions   uint64 // number of entries removed to make room for others
+	Expirations uint64 // number of expired entries removed by Purge
+	Entries     uint64 // number of entries currently held in the cache
+}
+
+// Stats returns the counters of the cache. The counters are updated
+// atomically, so reading them doesn't contend with the cache operations.
+func (c *Cache) Stats() Stats {
+	c.init()
+
+	var st Stats
+	c.mu.RLock()
+	for _, s := range c.shards {
+		st.Hits += atomic.LoadUint64(&s.hits)
+		st.Misses += atomic.LoadUint64(&s.misses)
+		st.Evictions += atomic.LoadUint64(&s.evictions)
+		st.Expirations += atomic.LoadUint64(&s.expirations)
+	}
+	c.mu.RUnlock()
+	st.Entries = uint64(c.Len())
+
+	return st
+}
+
+// ResetStats sets the hit, miss, eviction and expiration counters of the cache
+// back to 0, for instance after reporting them periodically. Entries are left
+// alone. Operations running concurrently may be counted either before or
+// after the reset.
+func (c *Cache) ResetStats() {
+	c.init()
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, s := range c.shards {
+		atomic.StoreUint64(&s.hits, 0)
+		atomic.StoreUint64(&s.misses, 0)
+		atomic.StoreUint64(&s.evictions, 0)
+		atomic.StoreUint64(&s.expirations, 0)
+	}
+}
+
+// FillRatio returns how full the cache is, as the number of entries over the
+// total capacity of the cache. That's the capacity set with WithTotalCapacity,
+// if any, or else the capacity of each shard, see WithCapacity, times the
+// number of shards, in which case the ratio only reaches 1 once every shard is
+// full. The ratio is between 0 and 1, and a cache with no capacity always has
+// a ratio of 0.
+func (c *Cache) FillRatio() float64 {
+	c.init()
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.cap <= 0 {
+		return 0
+	}
+	n := 0
+	for _, s := range c.shards {
+		n += s.len()
+	}
+	total := c.cap * len(c.shards)
+	if c.totalCap > 0 {
+		total = c.totalCap
+	}
+	if r := float64(n) / float64(total); r < 1 {
+		return r
+	}
+	return 1 // entries may go over capacity with WithManualEviction
+}
+
+// ShardFillRatios returns, for each shard, its number of entries over the
+// capacity, see WithCapacity, which applies to each shard separately. Ratios
+// are between 0 and 1. Shards that are full while others are mostly empty
+// point to keys that are unevenly spread over the shards. If the cache has no
+// capacity, all ratios are 0.
+func (c *Cache) ShardFillRatios() []float64 {
+	c.init()
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	ratios := make([]float64, len(c.shards))
+	if c.cap <= 0 {
+		return ratios
+	}
+	for i, s := range c.shards {
+		if r := float64(s.len()) / float64(c.cap); r < 1 {
+			ratios[i] = r
+		} else {
+			ratios[i] = 1
+		}
+	}
+	return ratios
+}
+
+// PurgeStats describes a purge of the cache
+type PurgeStats struct {
+	Time     time.Time     // when the purge started
+	Duration time.Duration // how long the purge took
+	Scanned  int           // number of entries examined
+	Removed  int           // number of expired entries removed
+}
+
+// LastPurgeStats returns what the last purge of the cache did and how long it
+// took, which helps tune how often to purge. Purges examine the entries of
+// each shard in the order they're due to expire and stop at the first one that
+// isn't, so they scan few more entries than they remove, unless many entries
+// were used since they were due, see PurgeWithBudget. For a rolling purger, see
+// StartRollingPurger, the last purge is that of a single shard. If the cache
+// was never purged, the zero PurgeStats is returned.
+func (c *Cache) LastPurgeStats() PurgeStats {
+	c.purgeMu.Lock()
+	defer c.purgeMu.Unlock()
+	return c.lastPurge
+}
+
+// notePurge records st as the last purge, setting its duration
+func (c *Cache) notePurge(st PurgeStats) {
+	st.Duration = time.Since(st.Time)
+	c.purgeMu.Lock()
+	c.lastPurge = st
+	c.purgeMu.Unlock()
+}
+
+// ShardLen returns the number of entries in the shard of index shardIdx, which
+// must be between 0 and the number of shards minus 1. Only that shard is
+// locked, so this is cheaper than Len when a single shard is of interest.
+func (c *Cache) ShardLen(shardIdx int) int {
+	c.init()
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if shardIdx < 0 || shardIdx >= len(c.shards) {
+		panic(fmt.Sprintf("shard index %d out of range [0, %d)", shardIdx, len(c.shards)))
+	}
+	return c.shards[shardIdx].len()
+}
+
+// ShardContention returns, for each shard, the number of times its lock was
+// found held by another goroutine when trying to acquire it. Consistently high
+// counts suggest the cache would benefit from more shards. The counts are only
+// collected when the cache is created with WithContentionTracking and are
+// always zero otherwise.
+func (c *Cache) ShardContention() []uint64 {
+	c.init()
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	counts := make([]uint64, len(c.shards))
+	for i, s := range c.shards {
+		counts[i] = atomic.LoadUint64(&s.contended)
+	}
+	return counts
+}
+
+// ShardStat holds the counters of a single shard of a Cache
+type ShardStat struct {
+	Entries     int    // number of entries currently held in the shard
+	Hits        uint64 // number of lookups that found a live entry
+	Misses      uint64 // number of lookups that found no entry or an expired one
+	Evictions   uint64 // number of entries removed to make room for others
+	Expirations uint64 // number of expired entries removed by Purge
+}
+
+// ShardStatsDetail returns the counters of each shard, indexed by shard
+// number. Unlike Stats, this makes it possible to spot shards that are hotter
+// or fuller than the others, which suggests keys aren't evenly distributed.
+func (c *Cache) ShardStatsDetail() []ShardStat {
+	c.init()
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	st := make([]ShardStat, len(c.shards))
+	for i, s := range c.shards {
+		st[i] = ShardStat{
+			Entries:     s.len(),
+			Hits:        atomic.LoadUint64(&s.hits),
+			Misses:      atomic.LoadUint64(&s.misses),
+			Evictions:   atomic.LoadUint64(&s.evictions),
+			Expirations: atomic.LoadUint64(&s.expirations),
+		}
+	}
+	return st
+}
+
+// CountBy returns the number of entries in the cache grouped by the label fn
+// derives from their keys. For instance, in a cache shared by several tenants,
+// fn could extract the tenant from the keys to report how much of the cache
+// each of them occupies. Entries that have expired but weren't purged yet are
+// counted.
+//
+// Shards are locked one at a time, so the counts aren't a snapshot of the
+// cache at a single point in time if it's being modified. Since fn is called
+// with a shard locked, it must not use the cache.
+func (c *Cache) CountBy(fn func(key interface{}) string) map[string]int {
+	c.init()
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	counts := make(map[string]int)
+	for _, s := range c.shards {
+		s.Lock()
+		for key := range s.idx {
+			counts[fn(key)]++
+		}
+		s.Unlock()
+	}
+	return counts
+}
@@ -0,0 +1,108 @@
+package cache
+
+import "time"
+
+// TypedCache is a Cache whose keys are of type K and whose values are of type
+// V, so that values don't need to be type-asserted by callers. It is safe for
+// concurrent use.
+type TypedCache[K comparable, V any] struct {
+	c *Cache
+}
+
+// NewTyped creates a new typed cache with the provided options
+func NewTyped[K comparable, V any](opts ...Option) *TypedCache[K, V] {
+	return &TypedCache[K, V]{c: New(opts...)}
+}
+
+// Add adds the new keyval pair to the cache. If the key is already present, it
+// is updated
+func (tc *TypedCache[K, V]) Add(key K, val V) {
+	tc.c.Add(key, val)
+}
+
+// Get retrieves an element from the cache. It also returns a second value
+// indicating whether the key was found
+func (tc *TypedCache[K, V]) Get(key K) (V, bool) {
+	v, ok := tc.c.Get(key)
+	return typed[V](v), ok
+}
+
+// Peek is like Get, but it doesn't count as a use of the entry, see
+// Cache.Peek
+func (tc *TypedCache[K, V]) Peek(key K) (V, bool) {
+	v, ok := tc.c.Peek(key)
+	return typed[V](v), ok
+}
+
+// Contains reports whether key is in the cache and hasn't expired, see
+// Cache.Contains
+func (tc *TypedCache[K, V]) Contains(key K) bool {
+	return tc.c.Contains(key)
+}
+
+// AddWithTTU is like Add, but the entry has its own TTU, see Cache.AddWithTTU
+func (tc *TypedCache[K, V]) AddWithTTU(key K, val V, ttu time.Duration) {
+	tc.c.AddWithTTU(key, val, ttu)
+}
+
+// Remove removes the entry of key from the cache and returns its value, or
+// the zero V if it wasn't there
+func (tc *TypedCache[K, V]) Remove(key K) V {
+	return typed[V](tc.c.Remove(key))
+}
+
+// Len returns the number of entries in the cache
+func (tc *TypedCache[K, V]) Len() int {
+	return tc.c.Len()
+}
+
+// Keys returns the keys of the entries that haven't expired, see Cache.Keys
+func (tc *TypedCache[K, V]) Keys() []K {
+	keys := tc.c.Keys()
+	typedKeys := make([]K, len(keys))
+	for i, key := range keys {
+		typedKeys[i] = key.(K)
+	}
+	return typedKeys
+}
+
+// Range calls f for each entry that hasn't expired, until f returns false. As
+// with Cache.Range, f must not use the cache.
+func (tc *TypedCache[K, V]) Range(f func(key K, val V) bool) {
+	tc.c.Range(func(key, value interface{}) bool {
+		return f(key.(K), typed[V](value))
+	})
+}
+
+// Purge removes the expired entries and returns how many were removed
+func (tc *TypedCache[K, V]) Purge() int {
+	return tc.c.Purge()
+}
+
+// Untyped returns the underlying Cache, which gives access to the rest of its
+// API. Only keys of type K and values of type V must be added to it.
+func (tc *TypedCache[K, V]) Untyped() *Cache {
+	return tc.c
+}
+
+// GetOrLoad returns the value of key, calling loader to load it if it isn't in
+// the cache. Concurrent calls for the same missing key are deduplicated, and
+// nothing is cached if the loader fails, as with Cache.GetOrCompute. If the
+// load fails, the zero V is returned along with the error.
+func (tc *TypedCache[K, V]) GetOrLoad(key K, loader func(key K) (V, error)) (V, error) {
+	v, err := tc.c.GetOrCompute(key, func(key interface{}) (interface{}, error) {
+		return loader(key.(K))
+	})
+	if err != nil {
+		var zero V
+		return zero, err
+	}
+	return typed[V](v), nil
+}
+
+// typed returns v as a V, or the zero V if v is nil. Values are only added to
+// a TypedCache as Vs, so v can't be of any other type.
+func typed[V any](v interface{}) V {
+	t, _ := v.(V)
+	return t
+}
@@ -0,0 +1,94 @@
+package cache_test
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/robteix/cache"
+)
+
+func TestTypedCache(t *testing.T) {
+	tc := cache.NewTyped[string, int](cache.WithShards(4))
+	tc.Add("one", 1)
+	tc.Add("two", 2)
+	tc.AddWithTTU("gone", 3, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+
+	if v, ok := tc.Get("one"); !ok || v != 1 {
+		t.Errorf("got %v, %v; want 1, true", v, ok)
+	}
+	if v, ok := tc.Peek("gone"); ok || v != 0 {
+		t.Errorf("got %v, %v for an expired entry; want 0, false", v, ok)
+	}
+	if !tc.Contains("two") || tc.Contains("three") {
+		t.Error("Contains doesn't match the entries")
+	}
+
+	sum := 0
+	tc.Range(func(key string, val int) bool {
+		sum += val
+		return true
+	})
+	if keys := tc.Keys(); len(keys) != 2 || sum != 3 {
+		t.Errorf("got keys %v and sum %d, want 2 keys summing 3", keys, sum)
+	}
+
+	if v := tc.Remove("two"); v != 2 {
+		t.Errorf("removed %v, want 2", v)
+	}
+	if v := tc.Remove("two"); v != 0 {
+		t.Errorf("removed %v for a missing key, want 0", v)
+	}
+	if n := tc.Purge(); n != 1 || tc.Len() != 1 {
+		t.Errorf("purged %d, %d left; want 1 and 1", n, tc.Len())
+	}
+}
+
+func TestTypedCache_GetOrLoad(t *testing.T) {
+	tc := cache.NewTyped[string, int]()
+
+	var calls int32
+	loader := func(key string) (int, error) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(10 * time.Millisecond) // give everyone a chance to pile up
+		return len(key), nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, err := tc.GetOrLoad("hello", loader); err != nil || v != 5 {
+				t.Errorf("got %v, %v; want 5, nil", v, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("loader called %d times, want 1", calls)
+	}
+	if v, ok := tc.Get("hello"); !ok || v != 5 {
+		t.Errorf("loaded value not cached: got %v, %v", v, ok)
+	}
+}
+
+func TestTypedCache_GetOrLoadError(t *testing.T) {
+	tc := cache.NewTyped[int, *int]()
+	errBoom := errors.New("boom")
+
+	v, err := tc.GetOrLoad(1, func(int) (*int, error) {
+		n := 1
+		return &n, errBoom
+	})
+	if err != errBoom || v != nil {
+		t.Errorf("got %v, %v; want nil, %v", v, err, errBoom)
+	}
+	if _, ok := tc.Get(1); ok {
+		t.Error("failed load was cached")
+	}
+}